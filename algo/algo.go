@@ -0,0 +1,153 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package algo is the registry of the proof of work algorithms supported by the pool
+package algo
+
+import (
+	"fmt"
+	"go-pool/template"
+	"strings"
+)
+
+const FAMILY_RANDOMX = "rx"
+const FAMILY_CRYPTONIGHT = "cn"
+
+type VerifyMethod uint8
+
+const (
+	// the share hash is computed by the daemon with the calc_pow RPC, which picks the hash
+	// function from the major version and the height
+	VERIFY_CALC_POW VerifyMethod = iota
+)
+
+// Algo describes the blobs, the jobs and the share verification of an algorithm
+type Algo struct {
+	Name   string // as sent to the miners in the jobs, for example "rx/0"
+	Family string
+
+	// position of the 4-byte nonce in the hashing blob and in the block blob
+	NonceOffset int
+
+	// if true, the jobs contain the height and the seed hash (RandomX).
+	// Otherwise they contain the block major version, which selects the variant.
+	SeedHash bool
+
+	Verify VerifyMethod
+}
+
+// MinBlobSize is the minimum size of the hashing blobs of the algorithm
+func (a *Algo) MinBlobSize() int {
+	return a.NonceOffset + 4
+}
+
+// NicehashOffset is the position of the nonce byte reserved by the pool for NiceHash miners
+func (a *Algo) NicehashOffset() int {
+	return a.NonceOffset + 3
+}
+
+// SetNonce writes the nonce in blob
+func (a *Algo) SetNonce(blob []byte, nonce []byte) {
+	copy(blob[a.NonceOffset:a.NonceOffset+4], nonce)
+}
+
+// Job returns a job for the miners
+func (a *Algo) Job(blob string, jobID string, target string, height uint64, seedHash string, majorVersion uint) template.Job {
+	j := template.Job{
+		Algo:   a.Name,
+		Blob:   blob,
+		Height: height,
+		JobID:  jobID,
+		Target: target,
+	}
+	if a.SeedHash {
+		j.SeedHash = seedHash
+	} else {
+		j.MajorVersion = majorVersion
+	}
+	return j
+}
+
+// Supported returns true if the algorithm is in the algo list sent by the miner at login.
+// Miners that don't send a list are assumed to support it.
+func (a *Algo) Supported(list []string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		v = strings.ToLower(v)
+		if v == a.Name || v == a.Family {
+			return true
+		}
+	}
+	return false
+}
+
+func randomx(name string) *Algo {
+	return &Algo{
+		Name:        name,
+		Family:      FAMILY_RANDOMX,
+		NonceOffset: 39,
+		SeedHash:    true,
+		Verify:      VERIFY_CALC_POW,
+	}
+}
+
+func cryptonight(name string) *Algo {
+	return &Algo{
+		Name:        name,
+		Family:      FAMILY_CRYPTONIGHT,
+		NonceOffset: 39,
+		Verify:      VERIFY_CALC_POW,
+	}
+}
+
+// the algorithms, by name. The names are the ones used by XMRig.
+var registry = map[string]*Algo{}
+
+func register(a *Algo) {
+	registry[a.Name] = a
+}
+
+func init() {
+	for _, v := range []string{"rx/0", "rx/wow", "rx/arq", "rx/graft", "rx/sfx", "rx/keva", "rx/yada"} {
+		register(randomx(v))
+	}
+	for _, v := range []string{"cn/0", "cn/1", "cn/2", "cn/r", "cn/fast", "cn/half", "cn/xao", "cn/rto",
+		"cn/rwz", "cn/zls", "cn/double", "cn/ccx", "cn/upx2", "cn-lite/0", "cn-lite/1", "cn-heavy/0",
+		"cn-heavy/tube", "cn-heavy/xhv", "cn-pico", "cn-pico/tlo"} {
+		register(cryptonight(v))
+	}
+}
+
+// Get returns the algorithm called name. Unknown RandomX and CryptoNight variants, such as the
+// ones of custom miner forks, are recognized by their prefix.
+func Get(name string) (*Algo, error) {
+	name = strings.ToLower(name)
+
+	if a, ok := registry[name]; ok {
+		return a, nil
+	}
+
+	switch {
+	case strings.HasPrefix(name, FAMILY_RANDOMX+"/"):
+		return randomx(name), nil
+	case strings.HasPrefix(name, FAMILY_CRYPTONIGHT+"/"), strings.HasPrefix(name, FAMILY_CRYPTONIGHT+"-"):
+		return cryptonight(name), nil
+	}
+	return nil, fmt.Errorf("unknown algorithm %s", name)
+}
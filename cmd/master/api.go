@@ -18,11 +18,15 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"go-pool/config"
 	"go-pool/database"
 	"go-pool/logger"
+	"go-pool/proxyproto"
 	"math"
+	"net"
+	"sort"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -41,11 +45,63 @@ type PubWithdraw struct {
 	Destinations int     `json:"destinations"`
 }
 
+type WorkerStats struct {
+	Name        string  `json:"name"`
+	Hashrate5m  float64 `json:"hashrate_5m"`
+	Hashrate15m float64 `json:"hashrate_15m"`
+	LastShare   uint64  `json:"last_share"`
+	HrChart     []Hr    `json:"hr_chart"`
+}
+
 var Coin float64
 
+// the operator IPs when neither operator_ips nor operator_token are set
+var DEFAULT_OPERATOR_IPS = []string{"127.0.0.1", "::1"}
+
+// operatorNets are the parsed MasterConfig.OperatorIPs
+var operatorNets []*net.IPNet
+
+// isOperator returns true if the request comes from the pool operator, see MasterConfig.OperatorToken.
+// The IP is the one of the TCP connection (or of the PROXY protocol header): behind a local reverse
+// proxy that doesn't send the header, every request comes from the proxy IP.
+func isOperator(c *gin.Context) bool {
+	token := config.Cfg.MasterConfig.OperatorToken
+	if token != "" {
+		auth := []byte(c.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) == 1 {
+			return true
+		}
+	}
+
+	ip := net.ParseIP(c.RemoteIP())
+	if ip == nil {
+		return false
+	}
+	for _, v := range operatorNets {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func StartApiServer() {
 	Coin = math.Pow10(config.Cfg.Atomic)
 
+	var err error
+	operatorIPs := config.Cfg.MasterConfig.OperatorIPs
+	if len(operatorIPs) == 0 && config.Cfg.MasterConfig.OperatorToken == "" {
+		operatorIPs = DEFAULT_OPERATOR_IPS
+	}
+	operatorNets, err = proxyproto.ParseTrusted(operatorIPs)
+	if err != nil {
+		panic(fmt.Errorf("operator_ips: %w", err))
+	}
+	trusted, err := proxyproto.ParseTrusted(config.Cfg.MasterConfig.TrustedProxies)
+	if err != nil {
+		panic(fmt.Errorf("trusted_proxies: %w", err))
+	}
+
 	gin.SetMode("release")
 	r := gin.Default()
 	r.SetTrustedProxies([]string{
@@ -100,6 +156,7 @@ func StartApiServer() {
 
 			"pplns_window_seconds": GetPplnsWindow(),
 			"withdrawals":          ws,
+			"shares_15m":           GetShareRatios(""),
 
 			// stats that do not change
 
@@ -115,7 +172,7 @@ func StartApiServer() {
 		addr := c.Param("addr")
 
 		if addr == config.Cfg.PoolAddress {
-			if c.RemoteIP() != "127.0.0.1" {
+			if !isOperator(c) {
 				c.JSON(404, gin.H{
 					"error": gin.H{
 						"code":    1, // address not found
@@ -170,19 +227,83 @@ func StartApiServer() {
 			"est_pending":     NotNan(Round6(GetEstPendingBalance(addr))),
 			"hr_chart":        Stats.HashrateCharts[addr],
 			"withdrawals":     uw,
+			"shares_15m":      GetShareRatios(addr),
+		})
+	})
+
+	r.GET("/stats/:addr/workers", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=10")
+
+		addr := c.Param("addr")
+
+		if addr == config.Cfg.PoolAddress {
+			if !isOperator(c) {
+				c.JSON(404, gin.H{
+					"error": gin.H{
+						"code":    1, // address not found
+						"message": "address not found",
+					},
+				})
+				return
+			}
+		}
+
+		Stats.RLock()
+		defer Stats.RUnlock()
+
+		hashrates := GetWorkerHashrates(addr)[addr]
+		workers := []WorkerStats{}
+		for name, lastShare := range Stats.KnownWorkers[addr] {
+			workers = append(workers, WorkerStats{
+				Name:        name,
+				Hashrate5m:  NotNan(Round0(hashrates[name].Hr5m)),
+				Hashrate15m: NotNan(Round0(hashrates[name].Hr15m)),
+				LastShare:   lastShare,
+				HrChart:     Stats.WorkerCharts[addr][name],
+			})
+		}
+		sort.Slice(workers, func(i, j int) bool {
+			return workers[i].Name < workers[j].Name
+		})
+
+		c.JSON(200, gin.H{
+			"workers": workers,
 		})
 	})
 
 	r.GET("/info", func(c *gin.Context) {
-		c.Header("Cache-Control", "max-age=3600")
+		c.Header("Cache-Control", "max-age=60")
 		c.JSON(200, gin.H{
 			"pool_fee_percent":  config.Cfg.MasterConfig.FeePercent,
-			"stratums":          config.Cfg.MasterConfig.Stratums,
+			"stratums":          GetStratums(),
 			"payment_threshold": config.Cfg.MasterConfig.MinWithdrawal,
 		})
 	})
 
-	err := r.Run("0.0.0.0:" + strconv.FormatInt(int64(config.Cfg.MasterConfig.ApiPort), 10))
+	// inventory and health of the slaves, only for the pool operator
+	r.GET("/slaves", func(c *gin.Context) {
+		if !isOperator(c) {
+			c.JSON(404, gin.H{
+				"error": gin.H{
+					"code":    1003,
+					"message": "endpoint only available to the pool operator",
+				},
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"slaves": GetSlaves(),
+		})
+	})
+
+	listener, err := net.Listen("tcp", "0.0.0.0:"+strconv.FormatInt(int64(config.Cfg.MasterConfig.ApiPort), 10))
+	if err != nil {
+		panic(err)
+	}
+	listener = proxyproto.NewListener(listener, trusted)
+
+	err = r.RunListener(listener)
 	if err != nil {
 		panic(err)
 	}
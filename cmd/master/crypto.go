@@ -18,43 +18,38 @@
 package main
 
 import (
-	"crypto/rand"
-	"fmt"
+	"crypto/ecdh"
 	"go-pool/config"
-
-	"golang.org/x/crypto/chacha20poly1305"
+	"go-pool/logger"
+	"go-pool/session"
 )
 
-func Encrypt(msg []byte) []byte {
-	aead, err := chacha20poly1305.NewX(config.MasterPass[:])
-	if err != nil {
-		panic(err)
-	}
+var MasterKey *ecdh.PrivateKey
 
-	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(msg)+aead.Overhead())
-	rand.Read(nonce)
+// public key (as string) -> slave name
+var slaveNames = make(map[string]string)
 
-	// Encrypt the message and append the ciphertext to the nonce.
-	return aead.Seal(nonce, nonce, msg, nil)
-}
-func Decrypt(msg []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.NewX(config.MasterPass[:])
+func LoadKeys() {
+	var err error
+	MasterKey, err = session.LoadKey("master.key")
 	if err != nil {
-		panic(err)
+		logger.Fatal("could not load master key:", err)
 	}
-
-	if len(msg) < aead.NonceSize() {
-		return []byte{}, fmt.Errorf("cyphertext too short")
+	logger.Info("Master public key is", session.PublicKeyString(MasterKey.PublicKey()))
+
+	for _, v := range config.Cfg.MasterConfig.Slaves {
+		key, err := session.ParsePublicKey(v.PublicKey)
+		if err != nil {
+			logger.Fatal("invalid public key for slave", v.Name, err)
+		}
+		slaveNames[string(key.Bytes())] = v.Name
 	}
-
-	// Split nonce and ciphertext.
-	nonce, ciphertext := msg[:aead.NonceSize()], msg[aead.NonceSize():]
-
-	// Decrypt the message and check it wasn't tampered with.
-	decrypted, err := aead.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return []byte{}, err
+	if len(slaveNames) == 0 {
+		logger.Warn("No slaves are allowed to connect. Add them to master_config.slaves.")
 	}
+}
 
-	return decrypted, nil
+func isSlaveAllowed(key *ecdh.PublicKey) bool {
+	_, ok := slaveNames[string(key.Bytes())]
+	return ok
 }
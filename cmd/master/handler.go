@@ -18,81 +18,88 @@
 package main
 
 import (
-	"encoding/binary"
 	"encoding/hex"
 	"go-pool/config"
+	"go-pool/database"
 	"go-pool/logger"
 	"go-pool/serializer"
+	"go-pool/session"
+	"go-pool/slave"
 	"go-pool/util"
-	"io"
 	"math"
 	"net"
+	"sync"
 )
 
-const Overhead = 40
+// Slave is a connected slave
+type Slave struct {
+	Id      uint64
+	Name    string // from the slaves allowlist
+	Address string
+	Session *session.Session
+
+	// locked by slavesMut
+	ConnectedAt   uint64
+	LastHeartbeat uint64
+	Heartbeat     slave.Heartbeat
+}
 
-// numConns is locked by the mutex of Stats
-var numConns = make(map[uint64]uint32)
+// connected slaves, by id
+var slaves = make(map[uint64]*Slave)
+var slavesMut sync.RWMutex
 
 func HandleSlave(conn net.Conn) {
 	var connId uint64 = util.RandomUint64()
 
-	for {
-		lenBuf := make([]byte, 2+Overhead)
-		_, err := io.ReadFull(conn, lenBuf)
-		if err != nil {
-			logger.Warn(err)
-			conn.Close()
-			Stats.Lock()
-			delete(numConns, connId)
-			Stats.Unlock()
-			return
-		}
-		lenBuf, err = Decrypt(lenBuf)
-		if err != nil {
-			logger.Warn(err)
-			conn.Close()
-			Stats.Lock()
-			delete(numConns, connId)
-			Stats.Unlock()
-			return
-		}
-		len := int(lenBuf[0]) | (int(lenBuf[1]) << 8)
+	defer conn.Close()
+
+	sess, err := session.Accept(conn, MasterKey, config.MasterPass[:], isSlaveAllowed)
+	if err != nil {
+		logger.Warn("slave handshake failed from", conn.RemoteAddr().String()+":", err)
+		return
+	}
+	slv := &Slave{
+		Id:          connId,
+		Name:        slaveNames[string(sess.RemoteKey.Bytes())],
+		Address:     remoteHost(conn),
+		Session:     sess,
+		ConnectedAt: util.Time(),
+	}
 
-		// read the actual message
+	logger.Info("Slave", slv.Name, "connected from", conn.RemoteAddr().String())
 
-		buf := make([]byte, len+Overhead)
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			logger.Warn(err)
-			conn.Close()
-			Stats.Lock()
-			delete(numConns, connId)
-			Stats.Unlock()
-			return
-		}
-		buf, err = Decrypt(buf)
+	slavesMut.Lock()
+	slaves[slv.Id] = slv
+	slavesMut.Unlock()
+	defer func() {
+		slavesMut.Lock()
+		delete(slaves, slv.Id)
+		slavesMut.Unlock()
+
+		updateWorkers()
+	}()
+
+	SendSettings(slv, config.GetSlaveSettings())
+
+	for {
+		buf, err := sess.Read()
 		if err != nil {
-			logger.Warn(err)
-			conn.Close()
-			Stats.Lock()
-			delete(numConns, connId)
-			Stats.Unlock()
+			logger.Warn("slave", slv.Name+":", err)
 			return
 		}
-		logger.NetDev("Received message:", hex.EncodeToString(buf))
-		OnMessage(buf, connId)
+		logger.NetDev("Received message from", slv.Name+":", hex.EncodeToString(buf))
+		OnMessage(buf, slv)
 	}
 }
 
-func SendToConn(conn net.Conn, data []byte) {
-	var dataLenBin = make([]byte, 0, 2)
-	dataLenBin = binary.LittleEndian.AppendUint16(dataLenBin, uint16(len(data)))
-	conn.Write(Encrypt(dataLenBin))
-	conn.Write(Encrypt(data))
+func SendToConn(sess *session.Session, data []byte) {
+	err := sess.Write(data)
+	if err != nil {
+		logger.Warn(err)
+	}
 }
 
-func OnMessage(msg []byte, connId uint64) {
+func OnMessage(msg []byte, slv *Slave) {
 	d := serializer.Deserializer{
 		Data: msg,
 	}
@@ -104,17 +111,8 @@ func OnMessage(msg []byte, connId uint64) {
 	packet := d.ReadUint8()
 
 	switch packet {
-	case 0: // Share Found packet
-		numShares := uint32(d.ReadUvarint())
-		wallet := d.ReadString()
-		diff := d.ReadUvarint()
-
-		if d.Error != nil {
-			logger.Error(d.Error)
-			return
-		}
-
-		OnShareFound(wallet, diff, numShares)
+	case 0: // Share Found packet, replaced by the share batches
+		logger.Error("slave", slv.Name, "sent a single share; it must be upgraded")
 	case 1: // Block Found packet
 		if config.Cfg.UseP2Pool {
 			logger.Error("received Block Found packet; is using P2Pool")
@@ -137,25 +135,20 @@ func OnMessage(msg []byte, connId uint64) {
 
 		logger.Info("Found block height", height, "reward", float64(reward)/math.Pow10(config.Cfg.Atomic), "hash", hash)
 		OnBlockFound(height, reward, hash)
-	case 2: // Stats packet
-		conns := uint32(d.ReadUvarint())
-
-		if d.Error != nil {
-			logger.Error(d.Error)
+	case 2: // Heartbeat packet
+		var h slave.Heartbeat
+		err := h.Deserialize(d.Data)
+		if err != nil {
+			logger.Error(err)
 			return
 		}
 
-		func() {
-			Stats.Lock()
-			defer Stats.Unlock()
-
-			numConns[connId] = conns
+		slavesMut.Lock()
+		slv.Heartbeat = h
+		slv.LastHeartbeat = util.Time()
+		slavesMut.Unlock()
 
-			Stats.Workers = 0
-			for _, v := range numConns {
-				Stats.Workers += v
-			}
-		}()
+		updateWorkers()
 	case 3: // P2Pool Share Found
 		if !config.Cfg.UseP2Pool {
 			logger.Error("received P2Pool Share Found packet; is not using P2Pool")
@@ -165,6 +158,34 @@ func OnMessage(msg []byte, connId uint64) {
 		height := d.ReadUvarint()
 
 		OnP2PoolShareFound(height)
+	case 4: // Share Batch packet
+		var batch database.ShareBatch
+		err := batch.Deserialize(d.Data)
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+
+		err = OnShareBatch(slv.Name, batch)
+		if err != nil {
+			logger.Error("could not store share batch", batch.ID, "from slave", slv.Name+":", err)
+			return
+		}
+
+		// acknowledge the batch, so that the slave removes it from its spool
+		s := serializer.Serializer{
+			Data: []byte{0},
+		}
+		s.AddUvarint(batch.ID)
+		SendToConn(slv.Session, s.Data)
+	case 5: // Rejected Shares packet
+		list, err := slave.DeserializeRejected(d.Data)
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+
+		OnRejectedShares(list)
 
 	default:
 		logger.Error("unknown packet type", packet)
@@ -18,14 +18,18 @@
 package main
 
 import (
+	"encoding/binary"
 	"go-pool/address"
 	"go-pool/config"
 	"go-pool/database"
 	"go-pool/logger"
+	"go-pool/slave"
 	"go-pool/util"
 	"math"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/duggavo/go-monero/rpc"
 	"github.com/duggavo/go-monero/rpc/daemon"
@@ -44,6 +48,9 @@ var MasterInfo Info
 var DB *bolt.DB
 
 func main() {
+	config.Load()
+	logger.LogLevel = config.Cfg.LogLevel
+
 	if !address.IsAddressValid(config.Cfg.PoolAddress) || !address.IsAddressValid(config.Cfg.FeeAddress) {
 		logger.Fatal("Pool or fee address are not valid")
 	}
@@ -65,6 +72,10 @@ func main() {
 			return err
 		}
 		_, err = tx.CreateBucketIfNotExists(database.SHARES)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.BATCH_IDS)
 
 		return err
 	})
@@ -74,6 +85,10 @@ func main() {
 
 	DatabaseCleanup()
 
+	LoadKeys()
+
+	go WatchSettings()
+
 	StartWallet()
 
 	srv, err := net.Listen("tcp", config.Cfg.MasterConfig.ListenAddress)
@@ -98,6 +113,7 @@ func main() {
 		conn, err := srv.Accept()
 		if err != nil {
 			logger.Error(err)
+			continue
 		}
 		go HandleSlave(conn)
 	}
@@ -143,41 +159,147 @@ func DatabaseCleanup() {
 	}
 
 	logger.Info("Database cleanup OK,", sharesRemoved, "outdated shares removed,", sharesKept, "mantained")
+
+	CleanupBatchIds()
 }
 
-func OnShareFound(wallet string, diff uint64, numShares uint32) {
-	logger.Info("Wallet", wallet, "found", numShares, "shares with diff", float64(diff/100)/10, "k HR:", Get5mHashrate(wallet))
+// CleanupBatchIds removes the ids of the share batches stored more than BATCH_ID_RETENTION ago
+func CleanupBatchIds() {
+	var batchesRemoved = 0
+	err := DB.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(database.BATCH_IDS)
 
-	if !address.IsAddressValid(wallet) {
-		logger.Warn("Wallet", wallet, "is not valid. Replacing it with fee address.")
-		wallet = config.Cfg.FeeAddress
+		// collected first, since deleting while iterating skips keys
+		var outdated [][]byte
+		err := buck.ForEach(func(k, v []byte) error {
+			if len(v) != 8 || binary.BigEndian.Uint64(v)+BATCH_ID_RETENTION < util.Time() {
+				outdated = append(outdated, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range outdated {
+			err = buck.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		batchesRemoved = len(outdated)
+		return nil
+	})
+	if err != nil {
+		logger.Error(err)
 	}
+	logger.Info(batchesRemoved, "outdated share batch ids removed")
+}
 
-	Stats.Lock()
-	Stats.Shares = append(Stats.Shares, StatsShare{
-		Count:  numShares,
-		Wallet: wallet,
-		Diff:   diff,
-		Time:   util.Time(),
-	})
-	Stats.Cleanup()
-	Stats.Unlock()
+// the ids of the stored share batches are kept this long, in seconds. A slave that stays
+// disconnected longer could have its batches stored twice.
+const BATCH_ID_RETENTION = 30 * 24 * 3600
 
-	DB.Update(func(tx *bolt.Tx) error {
-		buck := tx.Bucket(database.SHARES)
+// the outdated batch ids are removed this often
+const BATCH_ID_CLEANUP_INTERVAL = time.Hour
+
+// OnShareBatch stores the shares of a batch sent by a slave, with the batch timestamp.
+// Batches that were already stored (replayed because the ack was lost) are ignored.
+func OnShareBatch(slaveName string, batch database.ShareBatch) error {
+	if now := util.Time(); batch.Time > now {
+		batch.Time = now
+	}
+	for i, v := range batch.Shares {
+		batch.Shares[i].Wallet = validWallet(v.Wallet)
+	}
 
-		shareId, _ := buck.NextSequence()
+	spoolKey := []byte(slaveName + "/" + strconv.FormatUint(batch.Spool, 16))
+	batchKey := append(append(spoolKey, '/'), util.Itob(batch.ID)...)
 
-		shareData := database.Share{
-			Wallet: wallet,
-			Diff:   diff,
-			Time:   util.Time(),
+	var isNew bool
+	err := DB.Update(func(tx *bolt.Tx) error {
+		// every batch is checked: a batch that could not be stored is sent again after the
+		// following ones
+		idsBuck := tx.Bucket(database.BATCH_IDS)
+		if idsBuck.Get(batchKey) != nil {
+			return nil
 		}
 
-		buck.Put(util.Itob(shareId), shareData.Serialize())
+		isNew = true
 
-		return nil
+		buck := tx.Bucket(database.SHARES)
+		for _, v := range batch.Shares {
+			shareId, err := buck.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			shareData := database.Share{
+				Wallet: v.Wallet,
+				Diff:   v.Diff,
+				Time:   batch.Time,
+			}
+
+			err = buck.Put(util.Itob(shareId), shareData.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+
+		return idsBuck.Put(batchKey, util.Itob(util.Time()))
 	})
+	if err != nil {
+		return err
+	}
+	if !isNew {
+		logger.Debug("Share batch", batch.ID, "from slave", slaveName, "was already stored")
+		return nil
+	}
+
+	Stats.Lock()
+	for _, v := range batch.Shares {
+		logger.Info("Wallet", v.Wallet, "worker", v.Worker, "found", v.Count, "shares with diff", float64(v.Diff/100)/10, "k HR:", Get5mHashrate(v.Wallet))
+
+		Stats.Shares = append(Stats.Shares, StatsShare{
+			Count:  v.Count,
+			Wallet: v.Wallet,
+			Worker: v.Worker,
+			Diff:   v.Diff,
+			Time:   batch.Time,
+		})
+	}
+	Stats.Cleanup()
+	Stats.Unlock()
+
+	return nil
+}
+
+// OnRejectedShares stores the rejected and stale shares counted by a slave
+func OnRejectedShares(list []slave.RejectedShares) {
+	now := util.Time()
+
+	Stats.Lock()
+	defer Stats.Unlock()
+
+	for _, v := range list {
+		logger.Debug("Wallet", v.Key.Wallet, "worker", v.Key.Worker, "had", v.Count, "shares rejected:", slave.RejectReasons[v.Key.Reason])
+
+		Stats.Rejected = append(Stats.Rejected, StatsRejected{
+			Count:  v.Count,
+			Wallet: v.Key.Wallet,
+			Worker: v.Key.Worker,
+			Reason: v.Key.Reason,
+			Time:   now,
+		})
+	}
+}
+
+// validWallet replaces invalid wallets with the fee address
+func validWallet(wallet string) string {
+	if !address.IsAddressValid(wallet) {
+		logger.Warn("Wallet", wallet, "is not valid. Replacing it with fee address.")
+		return config.Cfg.FeeAddress
+	}
+	return wallet
 }
 
 // Important: Stats must be locked
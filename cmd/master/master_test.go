@@ -0,0 +1,173 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"go-pool/database"
+	"go-pool/util"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTestDB opens an empty database, in a temporary directory that is also the working directory
+// (the stats are saved to it)
+func openTestDB(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	DB, err = bolt.Open(filepath.Join(dir, "pool.db"), 0o600, bolt.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+
+	err = DB.Update(func(tx *bolt.Tx) error {
+		for _, v := range [][]byte{database.SHARES, database.BATCH_IDS} {
+			_, err := tx.CreateBucketIfNotExists(v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func numShares(t *testing.T) int {
+	var n int
+	DB.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(database.SHARES).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+func TestOnShareBatch(t *testing.T) {
+	openTestDB(t)
+
+	batch := func(spool, id uint64) database.ShareBatch {
+		return database.ShareBatch{
+			Spool:  spool,
+			ID:     id,
+			Time:   util.Time(),
+			Shares: []database.BatchShare{{Wallet: "w", Count: 1, Diff: 1000}},
+		}
+	}
+
+	steps := []struct {
+		slave  string
+		batch  database.ShareBatch
+		stored bool
+	}{
+		{"a", batch(1, 2), true},
+		{"a", batch(1, 2), false}, // ack lost
+		{"a", batch(1, 1), true},  // failed to store the first time, replayed after batch 2
+		{"a", batch(1, 3), true},
+		{"a", batch(2, 1), true}, // another spool
+		{"b", batch(1, 1), true}, // another slave
+		{"a", batch(1, 1), false},
+	}
+
+	expected := 0
+	for i, v := range steps {
+		err := OnShareBatch(v.slave, v.batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.stored {
+			expected++
+		}
+		if n := numShares(t); n != expected {
+			t.Fatalf("step %d: %d shares stored, expected %d", i, n, expected)
+		}
+	}
+}
+
+func TestGetWorkerHashrates(t *testing.T) {
+	now := util.Time()
+	Stats.Lock()
+	defer Stats.Unlock()
+	saved := Stats.Shares
+	defer func() { Stats.Shares = saved }()
+
+	Stats.Shares = []StatsShare{
+		{Wallet: "a", Worker: "rig1", Diff: 300 * 1000, Time: now},
+		{Wallet: "a", Worker: "rig1", Diff: 600 * 1000, Time: now - 10*60},
+		{Wallet: "a", Worker: "rig1", Diff: 900 * 1000, Time: now - 20*60}, // too old
+		{Wallet: "a", Worker: "rig2", Diff: 900 * 1000, Time: now - 60},
+		{Wallet: "b", Worker: "rig1", Diff: 300 * 1000, Time: now},
+	}
+
+	expected := map[string]map[string]WorkerHashrate{
+		"a": {
+			"rig1": {Hr5m: 1000, Hr15m: 1000},
+			"rig2": {Hr5m: 3000, Hr15m: 1000},
+		},
+		"b": {
+			"rig1": {Hr5m: 1000, Hr15m: 333},
+		},
+	}
+
+	all := GetWorkerHashrates("")
+	for wallet, workers := range expected {
+		for name, hr := range workers {
+			if all[wallet][name] != hr {
+				t.Errorf("%s/%s: %+v, expected %+v", wallet, name, all[wallet][name], hr)
+			}
+		}
+	}
+
+	one := GetWorkerHashrates("a")
+	if len(one) != 1 || one["a"]["rig2"] != expected["a"]["rig2"] {
+		t.Errorf("hashrates of a: %+v", one)
+	}
+}
+
+func TestCleanupBatchIds(t *testing.T) {
+	openTestDB(t)
+
+	DB.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(database.BATCH_IDS)
+		buck.Put([]byte("a/1/old"), util.Itob(util.Time()-BATCH_ID_RETENTION-1))
+		buck.Put([]byte("a/1/new"), util.Itob(util.Time()))
+		return buck.Put([]byte("a/1/bad"), []byte{1})
+	})
+
+	CleanupBatchIds()
+
+	DB.View(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(database.BATCH_IDS)
+		if n := buck.Stats().KeyN; n != 1 || buck.Get([]byte("a/1/new")) == nil {
+			t.Errorf("%d batch ids kept, expected only the new one", n)
+		}
+		return nil
+	})
+}
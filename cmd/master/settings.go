@@ -0,0 +1,72 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"go-pool/config"
+	"go-pool/logger"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SendSettings sends the runtime settings to a slave. Invalid settings are not sent, so that
+// the slave keeps its own.
+func SendSettings(slv *Slave, st config.SlaveSettings) {
+	if err := st.Validate(); err != nil {
+		logger.Debug("not sending settings to slave", slv.Name+":", err)
+		return
+	}
+
+	SendToConn(slv.Session, append([]byte{1}, st.Serialize()...))
+}
+
+// WatchSettings reloads the slave settings from the config file on SIGHUP, and pushes them
+// to all the connected slaves
+func WatchSettings() {
+	st := config.GetSlaveSettings()
+	if err := st.Validate(); err != nil {
+		logger.Warn("Slave settings are not valid, slaves will use their own:", err)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+
+	for range sigc {
+		cfg, err := config.Read()
+		if err != nil {
+			logger.Error("could not reload config:", err)
+			continue
+		}
+		st := cfg.SlaveConfig.Settings()
+		if err := st.Validate(); err != nil {
+			logger.Error("not applying slave settings:", err)
+			continue
+		}
+
+		config.SetSlaveSettings(st)
+		logger.Info("Reloaded slave settings: min diff", st.MinDiff, "share target time", st.ShareTargetTime,
+			"trust score", st.TrustScore, "template timeout", st.TemplateTimeout, "slave fee", st.SlaveFee)
+
+		slavesMut.RLock()
+		for _, v := range slaves {
+			go SendSettings(v, st)
+		}
+		slavesMut.RUnlock()
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"go-pool/config"
+	"go-pool/slave"
+	"go-pool/util"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a slave that hasn't sent a heartbeat for this many seconds is not healthy
+const HEARTBEAT_TIMEOUT = 30
+
+type SlaveStatus struct {
+	Name          string          `json:"name"`
+	Address       string          `json:"address"`
+	ConnectedAt   uint64          `json:"connected_at"`
+	LastHeartbeat uint64          `json:"last_heartbeat"`
+	Healthy       bool            `json:"healthy"`
+	Heartbeat     slave.Heartbeat `json:"heartbeat"`
+}
+
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// slavesMut must be at least RLocked
+func (s *Slave) isHealthy() bool {
+	return s.LastHeartbeat+HEARTBEAT_TIMEOUT >= util.Time() && s.Heartbeat.DaemonSynced
+}
+
+// GetSlaves returns the status of the connected slaves, sorted by name
+func GetSlaves() []SlaveStatus {
+	slavesMut.RLock()
+	defer slavesMut.RUnlock()
+
+	list := make([]SlaveStatus, 0, len(slaves))
+	for _, v := range slaves {
+		list = append(list, SlaveStatus{
+			Name:          v.Name,
+			Address:       v.Address,
+			ConnectedAt:   v.ConnectedAt,
+			LastHeartbeat: v.LastHeartbeat,
+			Healthy:       v.isHealthy(),
+			Heartbeat:     v.Heartbeat,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Address < list[j].Address
+	})
+	return list
+}
+
+// GetStratums returns the stratum addresses of the healthy slaves. If there are none, the
+// stratums from the config are returned.
+func GetStratums() []config.StratumAddr {
+	list := []config.StratumAddr{}
+	for _, v := range GetSlaves() {
+		if !v.Healthy {
+			continue
+		}
+
+		host := v.Heartbeat.PublicHost
+		if host == "" {
+			host = v.Address
+		}
+		desc := v.Heartbeat.Region
+		if desc == "" {
+			desc = v.Name
+		}
+
+		for _, p := range v.Heartbeat.Ports {
+			portDesc := desc
+			if p.Desc != "" {
+				portDesc += " " + p.Desc
+			}
+
+			addr := config.StratumAddr{
+				Addr:      net.JoinHostPort(host, strconv.FormatUint(uint64(p.Port), 10)),
+				Desc:      strings.TrimSpace(portDesc),
+				Tls:       p.Tls,
+				WebSocket: p.WebSocket,
+			}
+			if p.Tls {
+				addr.TlsFingerprint = v.Heartbeat.TlsFingerprint
+			}
+			list = append(list, addr)
+		}
+	}
+
+	if len(list) == 0 {
+		return config.Cfg.MasterConfig.Stratums
+	}
+	return list
+}
+
+// updateWorkers updates the number of miners connected to all the slaves
+func updateWorkers() {
+	var workers uint32
+
+	slavesMut.RLock()
+	for _, v := range slaves {
+		workers += v.Heartbeat.Connections
+	}
+	slavesMut.RUnlock()
+
+	Stats.Lock()
+	Stats.Workers = workers
+	Stats.Unlock()
+}
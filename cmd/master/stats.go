@@ -20,6 +20,7 @@ package main
 import (
 	"encoding/json"
 	"go-pool/logger"
+	"go-pool/slave"
 	"go-pool/util"
 	"math"
 	"os"
@@ -42,10 +43,31 @@ type LastBlock struct {
 type StatsShare struct {
 	Count  uint32 `json:"count"`
 	Wallet string `json:"wall"`
+	Worker string `json:"worker,omitempty"`
 	Diff   uint64 `json:"diff"`
 	Time   uint64 `json:"time"`
 }
 
+type StatsRejected struct {
+	Count  uint32 `json:"count"`
+	Wallet string `json:"wall"`
+	Worker string `json:"worker,omitempty"`
+	Reason uint8  `json:"reason"`
+	Time   uint64 `json:"time"`
+}
+
+type ShareRatios struct {
+	Valid   uint64 `json:"valid"`
+	Stale   uint64 `json:"stale"`
+	Invalid uint64 `json:"invalid"`
+
+	ValidRatio   float64 `json:"valid_ratio"`
+	StaleRatio   float64 `json:"stale_ratio"`
+	InvalidRatio float64 `json:"invalid_ratio"`
+
+	Reasons map[string]uint64 `json:"rejected_by_reason"`
+}
+
 type Statistics struct {
 	LastUpdate int64
 
@@ -53,7 +75,8 @@ type Statistics struct {
 	PoolHashrateChart []Hr
 	HashrateCharts    map[string][]Hr
 
-	Shares []StatsShare
+	Shares   []StatsShare
+	Rejected []StatsRejected // rejected and stale shares
 
 	LastBlock LastBlock
 
@@ -64,6 +87,9 @@ type Statistics struct {
 
 	KnownAddresses map[string]uint64
 
+	KnownWorkers map[string]map[string]uint64 // address -> worker -> last share time
+	WorkerCharts map[string]map[string][]Hr   // address -> worker -> hashrate chart
+
 	RecentWithdrawals []Withdrawal
 
 	Workers        uint32 // the current number of miners
@@ -92,6 +118,8 @@ type FoundInfo struct {
 var Stats = Statistics{
 	HashrateCharts: make(map[string][]Hr),
 	KnownAddresses: make(map[string]uint64, NUM_CHART_DATA),
+	KnownWorkers:   make(map[string]map[string]uint64),
+	WorkerCharts:   make(map[string]map[string][]Hr),
 }
 
 func StatsServer() {
@@ -157,6 +185,42 @@ func StatsServer() {
 				if !didFind {
 					delete(Stats.KnownAddresses, i)
 					delete(Stats.HashrateCharts, i)
+					delete(Stats.WorkerCharts, i)
+				}
+			}
+
+			if Stats.WorkerCharts == nil {
+				Stats.WorkerCharts = make(map[string]map[string][]Hr, 20)
+			}
+
+			hashrates := GetWorkerHashrates("")
+			for addr, workers := range Stats.KnownWorkers {
+				charts := Stats.WorkerCharts[addr]
+				if charts == nil {
+					charts = make(map[string][]Hr, len(workers))
+					Stats.WorkerCharts[addr] = charts
+				}
+
+				for w := range workers {
+					charts[w] = append(charts[w], Hr{
+						Time:     Stats.LastUpdate,
+						Hashrate: hashrates[addr][w].Hr15m,
+					})
+					for len(charts[w]) > NUM_CHART_DATA {
+						charts[w] = charts[w][1:]
+					}
+				}
+
+				// remove the charts of the workers that are not known anymore
+				for w := range charts {
+					if _, ok := workers[w]; !ok {
+						delete(charts, w)
+					}
+				}
+			}
+			for addr := range Stats.WorkerCharts {
+				if _, ok := Stats.KnownWorkers[addr]; !ok {
+					delete(Stats.WorkerCharts, addr)
 				}
 			}
 
@@ -203,6 +267,83 @@ func Get15mHashrate(wallet string) float64 {
 	return math.Round(numHashes / (15 * 60))
 }
 
+// WorkerHashrate is the hashrate of a worker over the last 5 and 15 minutes
+type WorkerHashrate struct {
+	Hr5m  float64
+	Hr15m float64
+}
+
+// GetWorkerHashrates returns the hashrates of the workers of wallet, or of all the wallets if it
+// is empty, by wallet and worker. The shares are only scanned once.
+// Stats MUST be at least RLocked
+func GetWorkerHashrates(wallet string) map[string]map[string]WorkerHashrate {
+	hashes := make(map[string]map[string]WorkerHashrate)
+
+	now := util.Time()
+	for _, v := range Stats.Shares {
+		deltaT := now - v.Time
+		if deltaT > 15*60 || (wallet != "" && v.Wallet != wallet) {
+			continue
+		}
+
+		workers := hashes[v.Wallet]
+		if workers == nil {
+			workers = make(map[string]WorkerHashrate)
+			hashes[v.Wallet] = workers
+		}
+		w := workers[v.Worker]
+		w.Hr15m += float64(v.Diff)
+		if deltaT <= 5*60 {
+			w.Hr5m += float64(v.Diff)
+		}
+		workers[v.Worker] = w
+	}
+
+	for _, workers := range hashes {
+		for name, w := range workers {
+			workers[name] = WorkerHashrate{
+				Hr5m:  math.Round(w.Hr5m / (5 * 60)),
+				Hr15m: math.Round(w.Hr15m / (15 * 60)),
+			}
+		}
+	}
+	return hashes
+}
+
+// GetShareRatios returns the number of valid, stale and invalid shares in the last 15 minutes.
+// If wallet is empty, the shares of the whole pool are counted.
+// Stats MUST be at least RLocked
+func GetShareRatios(wallet string) ShareRatios {
+	r := ShareRatios{
+		Reasons: make(map[string]uint64),
+	}
+
+	for _, v := range Stats.Shares {
+		if wallet == "" || v.Wallet == wallet {
+			r.Valid += uint64(v.Count)
+		}
+	}
+	for _, v := range Stats.Rejected {
+		if wallet != "" && v.Wallet != wallet {
+			continue
+		}
+		if v.Reason == slave.REJECT_STALE {
+			r.Stale += uint64(v.Count)
+		} else {
+			r.Invalid += uint64(v.Count)
+		}
+		r.Reasons[slave.RejectReasons[v.Reason]] += uint64(v.Count)
+	}
+
+	if total := float64(r.Valid + r.Stale + r.Invalid); total != 0 {
+		r.ValidRatio = Round3(float64(r.Valid) / total)
+		r.StaleRatio = Round3(float64(r.Stale) / total)
+		r.InvalidRatio = Round3(float64(r.Invalid) / total)
+	}
+
+	return r
+}
+
 // Removes shares older than 15 minutes. Also updates the Pool Hashrate in stats, and saves the stats.
 // Stats must be locked.
 func (s *Statistics) Cleanup() {
@@ -217,6 +358,18 @@ func (s *Statistics) Cleanup() {
 		}
 
 		s.KnownAddresses[v.Wallet] = v.Time
+
+		if v.Worker != "" {
+			if s.KnownWorkers == nil {
+				s.KnownWorkers = make(map[string]map[string]uint64, 20)
+			}
+			if s.KnownWorkers[v.Wallet] == nil {
+				s.KnownWorkers[v.Wallet] = make(map[string]uint64, 1)
+			}
+			if v.Time > s.KnownWorkers[v.Wallet][v.Worker] {
+				s.KnownWorkers[v.Wallet][v.Worker] = v.Time
+			}
+		}
 	}
 
 	kaddr := make(map[string]uint64, len(s.KnownAddresses))
@@ -230,7 +383,27 @@ func (s *Statistics) Cleanup() {
 
 	s.KnownAddresses = kaddr
 
+	// clean up known workers
+	for addr, workers := range s.KnownWorkers {
+		for w, v := range workers {
+			if v+3600*24 <= util.Time() {
+				delete(workers, w)
+			}
+		}
+		if len(workers) == 0 {
+			delete(s.KnownWorkers, addr)
+		}
+	}
+
 	s.Shares = shares2
+
+	rejected2 := make([]StatsRejected, 0, len(s.Rejected))
+	for _, v := range s.Rejected {
+		if v.Time+(15*60) >= util.Time() {
+			rejected2 = append(rejected2, v)
+		}
+	}
+	s.Rejected = rejected2
 	s.PoolHashrate = math.Round(totalHashes / (15 * 60))
 
 	data, err := json.Marshal(s)
@@ -43,6 +43,13 @@ func Updater() {
 		}
 	}()
 
+	go func() {
+		for {
+			time.Sleep(BATCH_ID_CLEANUP_INTERVAL)
+			CleanupBatchIds()
+		}
+	}()
+
 	for {
 		time.Sleep(5 * time.Second)
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
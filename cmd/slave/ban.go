@@ -0,0 +1,104 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"go-pool/config"
+	"go-pool/stratum"
+	"os"
+	"strings"
+	"time"
+)
+
+const BANS_FILE = "bans.json"
+
+const banUsage = `Usage:
+  slave ban list
+  slave ban add <ip or address> [duration, e.g. 24h; default: never expires] [reason]
+  slave ban lift <ip or address>
+A running slave reloads the bans within 10 seconds.`
+
+// BanCommand lets the operator list, add and lift bans
+func BanCommand(args []string) {
+	bans, err := stratum.NewBanManager(BANS_FILE, config.Cfg.SlaveConfig.Bans)
+	if err != nil {
+		fmt.Println("could not load bans:", err)
+		os.Exit(1)
+	}
+
+	if len(args) == 0 {
+		fmt.Println(banUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		for _, v := range bans.List() {
+			expires := "never"
+			if v.Expires != 0 {
+				expires = time.Unix(v.Expires, 0).Format(time.DateTime)
+			}
+			fmt.Printf("%s\texpires: %s\treason: %s\n", v.Target, expires, v.Reason)
+		}
+	case "add":
+		if len(args) < 2 {
+			fmt.Println(banUsage)
+			os.Exit(1)
+		}
+
+		var duration time.Duration
+		if len(args) > 2 {
+			duration, err = time.ParseDuration(args[2])
+			if err != nil || duration < 0 {
+				fmt.Println("invalid duration:", args[2])
+				os.Exit(1)
+			}
+		}
+		reason := "banned by the operator"
+		if len(args) > 3 {
+			reason = strings.Join(args[3:], " ")
+		}
+
+		bans.Ban(args[1], reason, duration)
+		saveBans(bans)
+		fmt.Println("Banned", args[1])
+	case "lift":
+		if len(args) < 2 {
+			fmt.Println(banUsage)
+			os.Exit(1)
+		}
+
+		if !bans.Lift(args[1]) {
+			fmt.Println(args[1], "is not banned")
+			os.Exit(1)
+		}
+		saveBans(bans)
+		fmt.Println("Lifted ban of", args[1])
+	default:
+		fmt.Println(banUsage)
+		os.Exit(1)
+	}
+}
+
+func saveBans(bans *stratum.BanManager) {
+	err := bans.Save()
+	if err != nil {
+		fmt.Println("could not save bans:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"go-pool/config"
+	"go-pool/logger"
+	"go-pool/template"
+	"go-pool/util"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/duggavo/go-monero/rpc/daemon"
+)
+
+// Size of the space reserved in the miner tx extra for the extra nonce.
+// The first 4 bytes are random for each slave process, so that slaves sharing the same
+// pool address don't hand out the same work; the last 4 bytes are a counter.
+const EXTRA_NONCE_SIZE = 8
+
+var extraNoncePrefix = util.RandomBytes(4)
+var extraNonceCounter atomic.Uint32
+
+var curTemplate *template.Template
+var templateMut sync.RWMutex
+
+func NextExtraNonce() []byte {
+	extraNonce := make([]byte, 0, EXTRA_NONCE_SIZE)
+	extraNonce = append(extraNonce, extraNoncePrefix...)
+	return binary.BigEndian.AppendUint32(extraNonce, extraNonceCounter.Add(1))
+}
+
+// fetchTemplate asks the daemon for a new block template. If extraNonce is nil, EXTRA_NONCE_SIZE
+// bytes are reserved in the template, otherwise extraNonce is included in it.
+func fetchTemplate(extraNonce []byte) (*template.Template, error) {
+	params := daemon.GetBlockTemplateParams{
+		WalletAddress: config.Cfg.PoolAddress,
+	}
+	if extraNonce == nil {
+		params.ReserveSize = EXTRA_NONCE_SIZE
+	} else {
+		params.ExtraNonce = hex.EncodeToString(extraNonce)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	res, err := client.GetBlockTemplate(ctx, params)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &template.Template{
+		Difficulty:     template.NewWideDiff(res.Difficulty),
+		Height:         res.Height,
+		Reward:         res.ExpectedReward,
+		ReservedOffset: int(res.ReservedOffset),
+		ReservedSize:   int(params.ReserveSize),
+		SeedHash:       res.SeedHash,
+	}
+	if res.WideDifficulty != "" {
+		tmpl.Difficulty, err = template.ParseWideDiff(res.WideDifficulty)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tmpl.Blob, err = hex.DecodeString(res.BlocktemplateBlob)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.HashingBlob, err = hex.DecodeString(res.BlockhashingBlob)
+	if err != nil {
+		return nil, err
+	}
+	majorVersion, n := binary.Uvarint(tmpl.Blob)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid major version in template blob")
+	}
+	tmpl.MajorVersion = uint(majorVersion)
+
+	CurInfo.Lock()
+	CurInfo.SeedHash = res.SeedHash
+	CurInfo.Difficulty = tmpl.Difficulty.Uint64()
+	CurInfo.FutureHeight = res.Height
+	CurInfo.BlockReward = res.ExpectedReward
+	CurInfo.Unlock()
+
+	return tmpl, nil
+}
+
+// UpdateTemplate fetches the block template that all the jobs are built from, until the next call.
+func UpdateTemplate() error {
+	tmpl, err := fetchTemplate(nil)
+	if err != nil {
+		return err
+	}
+
+	err = tmpl.Prepare()
+	if err != nil {
+		logger.Error("Cannot build blobs from the template, falling back to a daemon call per job:", err)
+	}
+
+	templateMut.Lock()
+	curTemplate = tmpl
+	templateMut.Unlock()
+
+	return nil
+}
+
+// NewBlobs returns a block template blob and its blockhashing blob, containing an unique extra nonce,
+// along with the template they are built from.
+func NewBlobs() (tmpl *template.Template, blob []byte, hashingBlob []byte, err error) {
+	templateMut.RLock()
+	tmpl = curTemplate
+	templateMut.RUnlock()
+
+	if tmpl == nil {
+		err = UpdateTemplate()
+		if err != nil {
+			return
+		}
+		templateMut.RLock()
+		tmpl = curTemplate
+		templateMut.RUnlock()
+	}
+
+	extraNonce := NextExtraNonce()
+
+	blob, hashingBlob, err = tmpl.WithExtraNonce(extraNonce)
+	if err == nil {
+		return
+	}
+
+	// the template cannot be modified locally, ask the daemon for one with our extra nonce
+	tmpl, err = fetchTemplate(extraNonce)
+	if err != nil {
+		return
+	}
+	return tmpl, tmpl.Blob, tmpl.HashingBlob, nil
+}
@@ -18,9 +18,11 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"go-pool/address"
 	"go-pool/config"
 	"go-pool/logger"
@@ -40,17 +42,23 @@ import (
 func HandleConnection(conn *stratum.Connection) {
 	// read login request
 	req := stratum.RequestLogin{}
-	conn.Conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-	reader := bufio.NewReaderSize(conn.Conn, config.MAX_REQUEST_SIZE)
-	err := stratum.ReadJSON(&req, reader)
+	conn.Conn.SetReadDeadline(time.Now().Add(srv.Limits.LoginTimeout()))
+	err := stratum.ReadJSON(&req, conn.Reader)
 	if err != nil {
 		logger.Debug("ReadJSON failed in server:", err)
+		if errors.Is(err, stratum.ErrMalformed) {
+			srv.Bans.OnMalformed(conn.IP)
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			srv.Limits.LoginTimeouts.Add(1)
+		}
 		srv.Kick(conn.Id)
 		return
 	}
+	srv.Limits.LoginDone(conn)
 	reqParams := req.Params
 	if reqParams.Login == "" {
 		logger.Debug("client sent a malformed login request")
+		srv.Bans.OnMalformed(conn.IP)
 		srv.Kick(conn.Id)
 		return
 	}
@@ -72,8 +80,7 @@ func HandleConnection(conn *stratum.Connection) {
 		conn.Nicehash = true
 	}
 
-	splitLogin := strings.Split(reqParams.Login, "+")
-	connAddress := splitLogin[0]
+	connAddress, connWorker, loginDiff := parseLogin(reqParams.Login, reqParams.Rigid)
 
 	if len(reqParams.Login) < 10 || !address.IsAddressValid(connAddress) {
 		logger.Warn("Address", connAddress, "is not valid")
@@ -89,24 +96,68 @@ func HandleConnection(conn *stratum.Connection) {
 		return
 	}
 
-	if len(splitLogin) > 1 {
-		diffVal, err := strconv.ParseUint(splitLogin[1], 10, 64)
+	if !poolAlgo.Supported(reqParams.Algo) {
+		logger.Debug("miner doesn't support", poolAlgo.Name, "algo list:", reqParams.Algo)
+		conn.Send(map[string]any{
+			"id":      req.ID,
+			"jsonrpc": "2.0",
+			"error": stratum.ErrorJson{
+				Code:    stratum.ERR_UNSUPPORTED_ALGO,
+				Message: "unsupported algorithm, this pool mines " + poolAlgo.Name,
+			},
+		})
+		srv.Kick(conn.Id)
+		return
+	}
+
+	if ban, ok := srv.Bans.IsBanned(connAddress); ok {
+		logger.Warn("Address", connAddress, "is banned:", ban.Reason)
+		conn.Send(map[string]any{
+			"id":      req.ID,
+			"jsonrpc": "2.0",
+			"error": stratum.ErrorJson{
+				Code:    stratum.ERR_BANNED,
+				Message: "banned",
+			},
+		})
+		srv.Kick(conn.Id)
+		return
+	}
+	srv.Conns.SetAddress(conn, connAddress)
+
+	// restore the state of the previous connection of the miner, so that it doesn't start over
+	resumeKey := stratum.ResumeKey(connAddress, connWorker, conn.IP)
+	resumed, isResumed := srv.Resume.Get(resumeKey)
+	if isResumed {
+		logger.Debug("Resuming session of", connAddress, "worker", connWorker, "diff", resumed.NextDiff,
+			"score", resumed.Score)
+		conn.Score = resumed.Score
+		// NiceHash mode is only kept if the miner still supports it
+		conn.Nicehash = conn.Nicehash && resumed.Nicehash
+	}
+	defer func() {
+		conn.Lock()
+		srv.Resume.Store(resumeKey, conn)
+		conn.Unlock()
+	}()
+
+	if loginDiff != "" && conn.Listener.FixedDiff == 0 {
+		diffVal, err := strconv.ParseUint(loginDiff, 10, 64)
 		if err != nil {
 			logger.Debug(err)
 		} else {
-			CurInfo.RLock()
-			if diffVal < config.Cfg.SlaveConfig.MinDiff {
-				diffVal = config.Cfg.SlaveConfig.MinDiff
-			} else if diffVal > CurInfo.Difficulty/2 {
-				diffVal = CurInfo.Difficulty / 2
-			}
-			CurInfo.RUnlock()
-			conn.CurrentJob.Diff = diffVal
+			conn.CurrentJob.Diff = requestedDiff(conn.Listener, float64(diffVal))
 		}
+	} else if isResumed && conn.Listener.FixedDiff == 0 {
+		conn.CurrentJob.Diff = requestedDiff(conn.Listener, resumed.NextDiff)
 	}
 
 	if conn.CurrentJob.Diff == 0 {
-		conn.CurrentJob.Diff = config.Cfg.SlaveConfig.MinDiff * 2
+		startDiff := conn.Listener.StartDiff
+		if startDiff == 0 {
+			startDiff = config.GetSlaveSettings().MinDiff * 2
+		}
+		conn.CurrentJob.Diff = uint64(limitDiff(conn.Listener, float64(startDiff)))
 	}
 	conn.NextDiff = float64(conn.CurrentJob.Diff)
 	conn.LastShare = time.Now().UnixMilli()
@@ -142,65 +193,30 @@ func HandleConnection(conn *stratum.Connection) {
 		}
 
 		// conn.JobBlob is not set with P2Pool
-		conn.CurrentJob.HashingBlob, err = hex.DecodeString(jobData.Blob)
+		connJob, jobDiff, err := parseP2PoolJob(jobData, conn.Nicehash)
 		if err != nil {
 			logger.Error(err)
 			srv.Kick(conn.Id)
 			return
 		}
-		if len(conn.CurrentJob.HashingBlob) < 43 {
-			logger.Error("HashingBlob", hex.EncodeToString(conn.CurrentJob.HashingBlob), "is too short")
-			srv.Kick(conn.Id)
-			return
-		}
-		if conn.Nicehash {
-			conn.CurrentJob.NicehashByte = conn.CurrentJob.HashingBlob[42]
-		}
-
-		jobTarget, err := hex.DecodeString(jobData.Target)
-		if err != nil {
-			logger.Error(err)
-			srv.Kick(conn.Id)
-			return
-		}
-
-		var jobDiff uint64
-		if len(jobTarget) == 4 {
-			logger.Dev("job target is 4-byte version")
-			jobDiff = template.ShortDiffToDiff(jobTarget)
-		} else {
-			logger.Dev("job target is 8-byte version")
-			jobDiff = template.MidDiffToDiff(jobTarget)
-		}
-
-		if jobDiff == 0 {
-			logger.Error("jobDiff is zero")
-			srv.Kick(conn.Id)
-			return
-		}
-		if conn.CurrentJob.Diff > jobDiff {
-			logger.Debug("conn diff > job diff, so we set conn diff from", conn.CurrentJob.Diff, "to", jobDiff)
-			conn.CurrentJob.Diff = jobDiff
+		connJob.Diff = conn.CurrentJob.Diff
+		if connJob.Diff > jobDiff {
+			logger.Debug("conn diff > job diff, so we set conn diff from", connJob.Diff, "to", jobDiff)
+			connJob.Diff = jobDiff
 		}
 
 		// This is the original P2Pool job difficulty
 		conn.P2Pool.JobDiff = jobDiff
 
-		conn.CurrentJob.JobID = jobData.JobID
+		conn.PushJob(connJob)
 
 		loginResponse := stratum.LoginResponse{
 			ID:     req.ID,
 			Status: "OK",
 			Result: stratum.LoginResponseResult{
-				ID: "0", //curJob.JobID,
-				Job: template.Job{
-					Algo:     config.Cfg.AlgoName,
-					Blob:     jobData.Blob,
-					Height:   jobData.Height,
-					JobID:    jobData.JobID,
-					SeedHash: jobData.SeedHash,
-					Target:   template.DiffToShortTarget(conn.CurrentJob.Diff),
-				},
+				ID: conn.SessionID,
+				Job: poolAlgo.Job(jobData.Blob, jobData.JobID, template.DiffToJobTarget(conn.CurrentJob.Diff),
+					jobData.Height, jobData.SeedHash, connJob.MajorVersion),
 				Status:     "OK",
 				Extensions: []string{"keepalive"},
 			},
@@ -222,34 +238,14 @@ func HandleConnection(conn *stratum.Connection) {
 
 				conn.Lock()
 
-				conn.LastJob = conn.CurrentJob
-
 				// update difficulty
-				logger.Debug("nextDiff is", conn.NextDiff, "mindiff is", config.Cfg.SlaveConfig.MinDiff)
-				if conn.NextDiff < float64(config.Cfg.SlaveConfig.MinDiff) {
-					conn.NextDiff = float64(config.Cfg.SlaveConfig.MinDiff)
-				} else if conn.NextDiff >= float64(conn.P2Pool.JobDiff) {
+				logger.Debug("nextDiff is", conn.NextDiff)
+				conn.NextDiff = limitDiff(conn.Listener, conn.NextDiff)
+				if conn.NextDiff >= float64(conn.P2Pool.JobDiff) {
 					conn.NextDiff = float64(conn.P2Pool.JobDiff)
 				}
 
-				logger.Debug("setting conn.Diff to nextDiff", conn.NextDiff)
-				conn.CurrentJob.Diff = uint64(conn.NextDiff)
-
-				conn.CurrentJob.HashingBlob, err = hex.DecodeString(curJob.Blob)
-				if err != nil {
-					logger.Error(err)
-					srv.Kick(conn.Id)
-					conn.Unlock()
-					return
-				}
-
-				if conn.Nicehash {
-					conn.CurrentJob.NicehashByte = conn.CurrentJob.HashingBlob[42]
-				}
-
-				conn.CurrentJob.JobID = curJob.JobID
-
-				jobTarget, err := hex.DecodeString(jobData.Target)
+				connJob, jobDiff, err := parseP2PoolJob(curJob, conn.Nicehash)
 				if err != nil {
 					logger.Error(err)
 					srv.Kick(conn.Id)
@@ -257,41 +253,24 @@ func HandleConnection(conn *stratum.Connection) {
 					return
 				}
 
-				var jobDiff uint64
-				if len(jobTarget) == 4 {
-					logger.Dev("job target is 4-byte version")
-					jobDiff = template.ShortDiffToDiff(jobTarget)
-				} else {
-					logger.Dev("job target is 8-byte version")
-					jobDiff = template.MidDiffToDiff(jobTarget)
-				}
-
-				if jobDiff == 0 {
-					logger.Error("jobDiff is zero")
-					srv.Kick(conn.Id)
-					conn.Unlock()
-					return
-				}
+				logger.Debug("setting conn.Diff to nextDiff", conn.NextDiff)
+				connJob.Diff = uint64(conn.NextDiff)
 
 				// This is the original P2Pool job difficulty
 				conn.P2Pool.JobDiff = jobDiff
 
-				if conn.CurrentJob.Diff > jobDiff {
-					logger.Debug("conn diff > job diff, so we set conn diff from", conn.CurrentJob.Diff, "to", jobDiff)
-					conn.CurrentJob.Diff = jobDiff
+				if connJob.Diff > jobDiff {
+					logger.Debug("conn diff > job diff, so we set conn diff from", connJob.Diff, "to", jobDiff)
+					connJob.Diff = jobDiff
 				}
 
+				conn.PushJob(connJob)
+
 				jb := &stratum.JobNotification{
 					Jsonrpc: "2.0",
 					Method:  "job",
-					Params: template.Job{
-						Algo:     config.Cfg.AlgoName,
-						Blob:     curJob.Blob,
-						Height:   curJob.Height,
-						JobID:    curJob.JobID,
-						SeedHash: curJob.SeedHash,
-						Target:   template.DiffToShortTarget(conn.CurrentJob.Diff),
-					},
+					Params: poolAlgo.Job(curJob.Blob, curJob.JobID, template.DiffToJobTarget(conn.CurrentJob.Diff),
+						curJob.Height, curJob.SeedHash, connJob.MajorVersion),
 				}
 				err = conn.Send(jb)
 				if err != nil {
@@ -305,80 +284,61 @@ func HandleConnection(conn *stratum.Connection) {
 
 	} else {
 		// generate job & send login response
+		var curJob *template.Job
+		var connJob stratum.ConnJob
 		if conn.Nicehash { // Send NiceHash Job
-			curJob, jobBlob, nicehashByte, err := GetNicehashJob(conn.CurrentJob.Diff)
-			if err != nil {
-				logger.Error(err)
-				srv.Kick(conn.Id)
-				return
-			}
-			conn.CurrentJob.NicehashByte = nicehashByte
-			conn.CurrentJob.Blob = jobBlob
-			conn.CurrentJob.HashingBlob, err = hex.DecodeString(curJob.Blob)
-			if err != nil {
-				logger.Error(err)
-				srv.Kick(conn.Id)
-				return
-			}
-			conn.CurrentJob.JobID = curJob.JobID
-
-			loginResponse := stratum.LoginResponse{
-				ID:     req.ID,
-				Status: "OK",
-				Result: stratum.LoginResponseResult{
-					ID:         "0", //curJob.JobID,
-					Job:        *curJob,
-					Status:     "OK",
-					Extensions: []string{"keepalive", "nicehash"},
-				},
-				Error: nil,
-			}
-			conn.Send(loginResponse)
+			curJob, connJob, err = GetNicehashJob(conn.CurrentJob.Diff)
 		} else { // Send non-nicehash job
-			curJob, jobBlob, err := GetJob(conn.CurrentJob.Diff)
-			if err != nil {
-				logger.Error(err)
-				srv.Kick(conn.Id)
-				return
-			}
-			conn.CurrentJob.Blob = jobBlob
-			conn.CurrentJob.HashingBlob, err = hex.DecodeString(curJob.Blob)
-			if err != nil {
-				logger.Error(err)
-				srv.Kick(conn.Id)
-				return
-			}
-			conn.CurrentJob.JobID = curJob.JobID
-
-			loginResponse := stratum.LoginResponse{
-				ID:     req.ID,
-				Status: "OK",
-				Result: stratum.LoginResponseResult{
-					ID:         "0", //curJob.JobID,
-					Job:        *curJob,
-					Status:     "OK",
-					Extensions: []string{"keepalive"},
-				},
-				Error: nil,
-			}
-			conn.Send(loginResponse)
+			curJob, connJob, err = GetJob(conn.CurrentJob.Diff)
 		}
+		if err != nil {
+			logger.Error(err)
+			srv.Kick(conn.Id)
+			return
+		}
+		conn.PushJob(connJob)
+
+		loginResponse := stratum.LoginResponse{
+			ID:     req.ID,
+			Status: "OK",
+			Result: stratum.LoginResponseResult{
+				ID:         conn.SessionID,
+				Job:        *curJob,
+				Status:     "OK",
+				Extensions: []string{"keepalive"},
+			},
+			Error: nil,
+		}
+		if conn.Nicehash {
+			loginResponse.Result.Extensions = append(loginResponse.Result.Extensions, "nicehash")
+		}
+		conn.Send(loginResponse)
 	}
 
 	// END generate job & send login response
 
 	// read "submit" request for solved shares
+	// reused, so that parsing the requests doesn't allocate
+	var jobReq stratum.RequestJob
 	for {
-		req := stratum.RequestJob{}
-		conn.Conn.SetReadDeadline(time.Now().Add(time.Duration(10*config.Cfg.SlaveConfig.ShareTargetTime) * time.Second))
-		reader := bufio.NewReaderSize(conn.Conn, config.MAX_REQUEST_SIZE)
-		err := stratum.ReadJSON(&req, reader)
+		req := &jobReq
+		conn.Conn.SetReadDeadline(time.Now().Add(time.Duration(10*config.GetSlaveSettings().ShareTargetTime) * time.Second))
+		err := stratum.ReadRequest(req, conn.Reader)
 
 		if err != nil {
 			logger.Debug("conn.go ReadJSON failed in server:", err)
+			if errors.Is(err, stratum.ErrMalformed) {
+				srv.Bans.OnMalformed(conn.IP)
+			}
 			srv.Kick(conn.Id)
 			return
 		}
+		if !srv.Limits.AllowRequest(conn) {
+			logger.Debug("rate limiting", conn.IP)
+			// not using conn.Send for better performance
+			conn.SendBytes([]byte("{\"error\":{\"code\":" + strconv.Itoa(stratum.ERR_RATE_LIMITED) + ",\"message\":\"too many requests\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
+			continue
+		}
 		if req.Method == "keepalived" {
 			// not using conn.Send for better performance
 			conn.SendBytes([]byte("{\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\",\"result\":{\"status\":\"KEEPALIVED\"}}"))
@@ -390,19 +350,59 @@ func HandleConnection(conn *stratum.Connection) {
 				},
 			})*/
 			continue
+		} else if req.Method == "getjob" {
+			if req.Params.ID != conn.SessionID {
+				// not using conn.Send for better performance
+				conn.SendBytes([]byte("{\"error\":{\"code\":" + strconv.Itoa(stratum.ERR_UNAUTHENTICATED) + ",\"message\":\"unauthenticated\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
+				continue
+			}
+
+			conn.Lock()
+			var job *template.Job
+			if config.Cfg.UseP2Pool {
+				// P2Pool jobs can't be made on demand, so the current one is sent again
+				cj := conn.CurrentJob
+				j := poolAlgo.Job(hex.EncodeToString(cj.HashingBlob), cj.JobID, template.DiffToJobTarget(cj.Diff),
+					cj.Height, cj.SeedHash, cj.MajorVersion)
+				job = &j
+			} else {
+				job, err = newJob(conn)
+			}
+			conn.Unlock()
+			if err != nil {
+				logger.Error(err)
+				srv.Kick(conn.Id)
+				return
+			}
+
+			conn.Send(stratum.Reply{
+				ID:      req.ID,
+				Jsonrpc: "2.0",
+				Result:  job,
+			})
+			continue
 		} else if req.Method != "submit" {
-			logger.Debug("Unknown method", req.Method, ". Skipping.")
+			logger.Debug("Unknown method", req.Method)
+			// not using conn.Send for better performance
+			conn.SendBytes([]byte("{\"error\":{\"code\":" + strconv.Itoa(stratum.ERR_METHOD_NOT_FOUND) + ",\"message\":\"method not found\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
 			continue
 		}
 
-		conn.Lock()
+		if req.Params.ID != conn.SessionID {
+			logger.Warn("INVALID SHARE RECEIVED: wrong session id")
+			rejectShare(conn, connAddress, connWorker, slave.REJECT_MALFORMED)
+			// not using conn.Send for better performance
+			conn.SendBytes([]byte("{\"error\":{\"code\":" + strconv.Itoa(stratum.ERR_UNAUTHENTICATED) + ",\"message\":\"unauthenticated\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
+			continue
+		}
 
-		theJob := conn.CurrentJob
+		conn.Lock()
 
 		// check the validity of share
 		if len(req.Params.Nonce) != 8 || len(req.Params.Result) != 64 ||
 			!util.IsHex(req.Params.Nonce) || !util.IsHex(req.Params.Result) {
 			logger.Warn("INVALID SHARE RECEIVED: malformed share")
+			rejectShare(conn, connAddress, connWorker, slave.REJECT_MALFORMED)
 			// not using conn.Send for better performance
 			conn.SendBytes([]byte("{\"error\":{\"code\":-1,\"message\":\"malformed share\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
 			/*conn.Send(stratum.Reply{
@@ -416,11 +416,17 @@ func HandleConnection(conn *stratum.Connection) {
 			conn.Unlock()
 			continue
 		}
-		if req.Params.JobID == conn.LastJob.JobID && req.Params.JobID != "" {
-			logger.Debug("Using latest job")
-			theJob = conn.LastJob
-		} else if req.Params.JobID != theJob.JobID {
+		theJob, err := conn.FindJob(req.Params.JobID)
+		if err == stratum.ErrStaleJob {
+			logger.Warn("STALE SHARE RECEIVED: job", req.Params.JobID, "is too old")
+			rejectShare(conn, connAddress, connWorker, slave.REJECT_STALE)
+			// not using conn.Send for better performance
+			conn.SendBytes([]byte("{\"error\":{\"code\":" + strconv.Itoa(stratum.ERR_STALE_SHARE) + ",\"message\":\"stale share\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
+			conn.Unlock()
+			continue
+		} else if err != nil {
 			logger.Warn("INVALID SHARE RECEIVED: wrong job id")
+			rejectShare(conn, connAddress, connWorker, slave.REJECT_WRONG_JOB)
 			// not using conn.Send for better performance
 			conn.SendBytes([]byte("{\"error\":{\"code\":-1,\"message\":\"wrong job id\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
 			/*conn.Send(stratum.Reply{
@@ -433,16 +439,19 @@ func HandleConnection(conn *stratum.Connection) {
 			})*/
 			conn.Unlock()
 			continue
-		} else {
+		}
+		if theJob.JobID != conn.CurrentJob.JobID {
 			logger.Debug("Using older job")
 		}
-		resultHash, err := hex.DecodeString(req.Params.Result)
+		resultHash := make([]byte, hex.DecodedLen(len(req.Params.Result)))
+		_, err = hex.Decode(resultHash, req.Params.Result)
 		if err != nil {
 			// we have already checked that this hash is valid hexadecimal with valid length.
 			// For this reason, hex.DecodeString should never fail
 			panic("ERROR DECODING HEX HASH! This should NEVER happen!")
 		}
-		resultNonce, err := hex.DecodeString(req.Params.Nonce)
+		resultNonce := make([]byte, hex.DecodedLen(len(req.Params.Nonce)))
+		_, err = hex.Decode(resultNonce, req.Params.Nonce)
 		if err != nil {
 			// we have already checked that the nonce is valid hexadecimal with valid length.
 			// For this reason, hex.DecodeString should never fail
@@ -453,6 +462,7 @@ func HandleConnection(conn *stratum.Connection) {
 
 		if conn.Nicehash && theJob.NicehashByte != 0 && resultNonce[3] != theJob.NicehashByte {
 			logger.Warn("INVALID SHARE RECEIVED: wrong nicehash nonce")
+			rejectShare(conn, connAddress, connWorker, slave.REJECT_NICEHASH)
 			// not using conn.Send for better performance
 			conn.SendBytes([]byte("{\"error\":{\"code\":-1,\"message\":\"wrong nicehash nonce\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
 			/*conn.Send(stratum.Reply{
@@ -467,46 +477,66 @@ func HandleConnection(conn *stratum.Connection) {
 			continue
 		}
 
+		nonceVal := binary.LittleEndian.Uint32(resultNonce)
+		if _, ok := theJob.Submitted[nonceVal]; ok {
+			logger.Warn("INVALID SHARE RECEIVED: duplicate share")
+			rejectShare(conn, connAddress, connWorker, slave.REJECT_DUPLICATE)
+			conn.Score = -100
+			// not using conn.Send for better performance
+			conn.SendBytes([]byte("{\"error\":{\"code\":" + strconv.Itoa(stratum.ERR_DUPLICATE_SHARE) + ",\"message\":\"duplicate share\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
+			conn.Unlock()
+			continue
+		}
+
 		resultHashingBlob := make([]byte, len(theJob.HashingBlob))
 		copy(resultHashingBlob, theJob.HashingBlob)
 
 		resultBlockBlob := make([]byte, len(theJob.Blob))
 
 		// set the nonce in the blockhashing blob
-		resultHashingBlob[39] = resultNonce[0]
-		resultHashingBlob[40] = resultNonce[1]
-		resultHashingBlob[41] = resultNonce[2]
-		resultHashingBlob[42] = resultNonce[3]
+		poolAlgo.SetNonce(resultHashingBlob, resultNonce)
 
 		// set the nonce in the block blob
 		if !config.Cfg.UseP2Pool { // with p2pool, we don't bother about the block blob
 			copy(resultBlockBlob, theJob.Blob)
 
-			resultBlockBlob[39] = resultNonce[0]
-			resultBlockBlob[40] = resultNonce[1]
-			resultBlockBlob[41] = resultNonce[2]
-			resultBlockBlob[42] = resultNonce[3]
+			poolAlgo.SetNonce(resultBlockBlob, resultNonce)
 		}
 
 		resultHashingBlobString := hex.EncodeToString(resultHashingBlob)
 
 		shareDiff := template.HashToDiff(resultHash)
+		isBlock := template.CheckHash(resultHash, theJob.NetDiff)
 
 		if config.Cfg.UseP2Pool {
 			logger.Dev("Computed share diff:", shareDiff, "P2pool diff:", conn.P2Pool.JobDiff)
 		}
 
-		CurInfo.Lock()
-		if shareDiff >= CurInfo.Difficulty || conn.Score < int32(config.Cfg.SlaveConfig.TrustScore) || util.RandomFloat() > 0.5 {
+		powParams := daemon.CalcPowParameters{
+			MajorVersion: theJob.MajorVersion,
+			Height:       theJob.Height,
+			BlockBlob:    resultHashingBlobString,
+			SeedHash:     theJob.SeedHash,
+		}
+
+		if isBlock || conn.Score < int32(config.GetSlaveSettings().TrustScore) || util.RandomFloat() > 0.5 {
 			logger.Debug("Checking share PoW (score", conn.Score, ")")
-			calcPow, err := client.CalcPow(context.Background(), daemon.CalcPowParameters{
-				MajorVersion: CurInfo.MajorVersion,
-				Height:       CurInfo.Height,
-				BlockBlob:    resultHashingBlobString,
-				SeedHash:     CurInfo.SeedHash,
-			})
-			if err != nil {
+
+			// the connection is unlocked while waiting, so that jobs can still be sent to it
+			conn.Unlock()
+			calcPow, err := VerifyPow(powParams)
+			conn.Lock()
+
+			if err == ErrQueueFull {
+				logger.Warn("share verification queue is full, rejecting share")
+				rejectShare(conn, connAddress, connWorker, slave.REJECT_SERVER_BUSY)
+				// not using conn.Send for better performance
+				conn.SendBytes([]byte("{\"error\":{\"code\":" + strconv.Itoa(stratum.ERR_SERVER_BUSY) + ",\"message\":\"server busy\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
+				conn.Unlock()
+				continue
+			} else if err != nil {
 				logger.Warn("error getting pow:", err)
+				rejectShare(conn, connAddress, connWorker, slave.REJECT_INTERNAL)
 				conn.Send(stratum.Reply{
 					ID:      req.ID,
 					Jsonrpc: "2.0",
@@ -516,26 +546,25 @@ func HandleConnection(conn *stratum.Connection) {
 					},
 				})
 				conn.Unlock()
-				CurInfo.Unlock()
 				continue
 			}
-			if calcPow != req.Params.Result {
-				logger.Warn("INVALID SHARE RECEIVED: wrong hash: received:", req.Params.Result, ", should be", calcPow)
+			if calcPow != string(req.Params.Result) {
+				logger.Warn("INVALID SHARE RECEIVED: wrong hash: received:", string(req.Params.Result), ", should be", calcPow)
+				rejectShare(conn, connAddress, connWorker, slave.REJECT_WRONG_HASH)
 				conn.Score = -100
 				// not using conn.Send for better performance
 				conn.SendBytes([]byte("{\"error\":{\"code\":-1,\"message\":\"wrong hash\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
 
 				conn.Unlock()
-				CurInfo.Unlock()
 				continue
 			}
 		} else {
 			logger.Dev("Skipping share PoW")
 		}
-		CurInfo.Unlock()
 
 		if shareDiff < theJob.Diff {
 			logger.Warn("INVALID SHARE RECEIVED: hash does not meet difficulty: expected at least", theJob.Diff, ", got", shareDiff)
+			rejectShare(conn, connAddress, connWorker, slave.REJECT_LOW_DIFF)
 			// not using conn.Send for better performance
 			conn.SendBytes([]byte("{\"error\":{\"code\":-1,\"message\":\"hash does not meet diff\"},\"id\":" + strconv.FormatUint(req.ID, 10) + ",\"jsonrpc\":\"2.0\"}"))
 			/*conn.Send(stratum.Reply{
@@ -552,16 +581,21 @@ func HandleConnection(conn *stratum.Connection) {
 
 		// Share is valid!
 
+		theJob.Submitted[nonceVal] = struct{}{}
 		conn.Score += 1
+		numAccepted.Add(1)
+		if srv.Bans.OnShare(conn.IP, connAddress, true) {
+			srv.KickBanned(conn.IP, connAddress)
+		}
 
-		logger.Info("Share:", connAddress, "diff", theJob.Diff)
+		logger.Info("Share:", connAddress, "worker", connWorker, "diff", theJob.Diff)
 
-		if util.RandomFloat() > float32(1-(config.Cfg.SlaveConfig.SlaveFee/100)) {
-			slave.SendShare(config.Cfg.FeeAddress, theJob.Diff)
+		if util.RandomFloat() > float32(1-(config.GetSlaveSettings().SlaveFee/100)) {
+			slave.SendShare(config.Cfg.FeeAddress, "", theJob.Diff)
 		} else if conn.IsTls || util.RandomFloat() > 0.001 {
-			slave.SendShare(connAddress, theJob.Diff)
+			slave.SendShare(connAddress, connWorker, theJob.Diff)
 		} else {
-			slave.SendShare(config.Cfg.FeeAddress, theJob.Diff)
+			slave.SendShare(config.Cfg.FeeAddress, "", theJob.Diff)
 		}
 
 		if config.Cfg.UseP2Pool && shareDiff > conn.P2Pool.JobDiff {
@@ -569,19 +603,16 @@ func HandleConnection(conn *stratum.Connection) {
 
 			logger.Info("Found P2Pool share")
 
-			res, err := conn.P2Pool.SubmitShare(resultNonce, theJob.JobID, req.Params.Result)
+			res, err := conn.P2Pool.SubmitShare(resultNonce, theJob.JobID, string(req.Params.Result))
 			logger.Info("res and err:", res, err)
 
-			CurInfo.RLock()
-			slave.SendShareFound(CurInfo.Height)
-			CurInfo.RUnlock()
+			slave.SendShareFound(theJob.Height)
 		}
-		if !config.Cfg.UseP2Pool && shareDiff >= CurInfo.Difficulty {
+		if !config.Cfg.UseP2Pool && isBlock {
 			// this share is a valid block. Hooray!
 
-			CurInfo.Lock()
-			logger.Info("Found block at height", CurInfo.FutureHeight)
-			logger.Info("difficulty:", CurInfo.Difficulty)
+			logger.Info("Found block at height", theJob.Height)
+			logger.Info("difficulty:", theJob.NetDiff)
 			logger.Debug("hashing blob:", resultHashingBlobString)
 
 			var res *daemon.SubmitBlockResult
@@ -598,49 +629,39 @@ func HandleConnection(conn *stratum.Connection) {
 					if err != nil {
 						logger.Error(err)
 						conn.Unlock()
-						CurInfo.Unlock()
 						continue
 					}
-					slave.SendBlockFound(CurInfo.FutureHeight, CurInfo.BlockReward, blockHash)
+					slave.SendBlockFound(theJob.Height, theJob.Reward, blockHash)
 				} else { // Older Monero forks
 					time.Sleep(500 * time.Millisecond)
-					blockHeader, err := client.GetBlockHeaderByHeight(context.Background(), CurInfo.FutureHeight)
+					blockHeader, err := client.GetBlockHeaderByHeight(context.Background(), theJob.Height)
 					if err != nil {
 						logger.Error(err)
 						conn.Unlock()
-						CurInfo.Unlock()
 						continue
 					}
 					blockHash, err := hex.DecodeString(blockHeader.BlockHeader.Hash)
 					if err != nil {
 						logger.Error(err)
 						conn.Unlock()
-						CurInfo.Unlock()
 						continue
 					}
-					slave.SendBlockFound(CurInfo.FutureHeight, CurInfo.BlockReward, blockHash)
+					slave.SendBlockFound(theJob.Height, theJob.Reward, blockHash)
 				}
 			}
-			CurInfo.Unlock()
 		}
 
 		// Try updating the diff
-
-		t := time.Now().UnixMilli()
-		deltaT := t - conn.LastShare
-		if deltaT < int64(config.Cfg.SlaveConfig.ShareTargetTime*1000/4) {
-			deltaT = int64(config.Cfg.SlaveConfig.ShareTargetTime * 1000 / 4)
-		} else if deltaT > int64(config.Cfg.SlaveConfig.ShareTargetTime*1000*4) {
-			deltaT = int64(config.Cfg.SlaveConfig.ShareTargetTime * 1000 * 4)
-		}
-		estHr := float64(theJob.Diff) / float64(deltaT)
-		nextDiff := estHr * 1000 * float64(config.Cfg.SlaveConfig.ShareTargetTime)
-		nextDiff = (nextDiff + 6*conn.NextDiff) / 7
-		logger.Debug("Next Diff:", nextDiff)
-		conn.NextDiff = nextDiff
+		nextDiff := srv.Vardiff.NextDiff(conn, theJob.Diff, config.GetSlaveSettings().ShareTargetTime)
+		conn.NextDiff = limitDiff(conn.Listener, nextDiff)
+		logger.Debug("Next Diff:", conn.NextDiff)
+		srv.Resume.Store(resumeKey, conn)
 
 		conn.LastShare = time.Now().UnixMilli()
 
+		// with P2Pool, the difficulty is updated on the next P2Pool job
+		retarget := !config.Cfg.UseP2Pool && srv.NeedsRetarget(conn)
+
 		conn.Unlock()
 
 		// not using conn.Send for better performance
@@ -652,40 +673,183 @@ func HandleConnection(conn *stratum.Connection) {
 				"status": "OK",
 			},
 		})*/
+
+		if retarget {
+			conn.Lock()
+			logger.Debug("Retargeting from", conn.CurrentJob.Diff, "to", conn.NextDiff)
+			err = sendJob(conn)
+			conn.Unlock()
+			if err != nil {
+				logger.Error(err)
+				srv.Kick(conn.Id)
+				return
+			}
+		}
+	}
+}
+
+// limitDiff applies the difficulty profile of the listener to diff
+func limitDiff(l *config.ListenerConfig, diff float64) float64 {
+	if l.FixedDiff != 0 {
+		return float64(l.FixedDiff)
+	}
+
+	minDiff := l.MinDiff
+	if minDiff == 0 {
+		minDiff = config.GetSlaveSettings().MinDiff
+	}
+
+	if diff < float64(minDiff) {
+		return float64(minDiff)
+	} else if l.MaxDiff != 0 && diff > float64(l.MaxDiff) {
+		return float64(l.MaxDiff)
+	}
+	return diff
+}
+
+// requestedDiff returns the starting difficulty of a miner that asked for diff, or that resumed its
+// session with it: the difficulty profile of the listener is applied, and it's capped to half the
+// network difficulty
+func requestedDiff(l *config.ListenerConfig, diff float64) uint64 {
+	d := uint64(limitDiff(l, diff))
+
+	CurInfo.RLock()
+	defer CurInfo.RUnlock()
+
+	// the difficulty is 0 until the first template is fetched
+	if CurInfo.Difficulty > 1 && d > CurInfo.Difficulty/2 {
+		d = CurInfo.Difficulty / 2
+	}
+	return d
+}
+
+// rejectShare counts a rejected share, and bans the miner if it has too many invalid shares.
+// The connection is closed when the miner is banned.
+func rejectShare(conn *stratum.Connection, wallet, worker string, reason uint8) {
+	numRejected.Add(1)
+	slave.SendRejected(wallet, worker, reason)
+
+	switch reason {
+	case slave.REJECT_STALE, slave.REJECT_SERVER_BUSY, slave.REJECT_INTERNAL:
+		// not the miner's fault
+		return
+	}
+	if srv.Bans.OnShare(conn.IP, wallet, false) {
+		srv.KickBanned(conn.IP, wallet)
+	}
+}
+
+const MAX_WORKER_LENGTH = 64
+const DEFAULT_WORKER = "default"
+
+// parseLogin splits a login of the form address[.worker][+diff] into its parts.
+// If the login has no worker name, rigid is used.
+func parseLogin(login, rigid string) (addr, worker, diff string) {
+	addr, diff, _ = strings.Cut(login, "+")
+
+	// some miners put the worker after the difficulty
+	diff, diffWorker, _ := strings.Cut(diff, ".")
+
+	addr, worker, _ = strings.Cut(addr, ".")
+	if worker == "" {
+		worker = diffWorker
+	}
+	if worker == "" {
+		worker = rigid
 	}
+
+	return addr, cleanWorkerName(worker), diff
 }
 
-func GetJob(jobDiff uint64) (j *template.Job, blocktemplateBlob []byte, err error) {
+// cleanWorkerName replaces unsafe characters in worker names, since they are published in the API
+func cleanWorkerName(worker string) string {
+	if len(worker) > MAX_WORKER_LENGTH {
+		worker = worker[:MAX_WORKER_LENGTH]
+	}
+
+	w := []byte(worker)
+	for i, c := range w {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			w[i] = '_'
+		}
+	}
+	if len(w) == 0 {
+		return DEFAULT_WORKER
+	}
+	return string(w)
+}
 
-	tmpl, err := client.GetBlockTemplate(context.Background(), daemon.GetBlockTemplateParams{
-		WalletAddress: config.Cfg.PoolAddress,
-		ExtraNonce:    hex.EncodeToString(util.RandomBytes(8)),
-	})
+// parseP2PoolJob returns the ConnJob for a P2Pool job, and the P2Pool job difficulty.
+// The ConnJob difficulty is not set.
+func parseP2PoolJob(jobData *p2pool.MultiClientJob, nicehash bool) (cj stratum.ConnJob, jobDiff uint64, err error) {
+	cj.HashingBlob, err = hex.DecodeString(jobData.Blob)
 	if err != nil {
 		return
 	}
+	if len(cj.HashingBlob) < poolAlgo.MinBlobSize() {
+		err = fmt.Errorf("HashingBlob %s is too short", jobData.Blob)
+		return
+	}
+	if nicehash {
+		cj.NicehashByte = cj.HashingBlob[poolAlgo.NicehashOffset()]
+	}
 
-	blocktemplateBlob, err = hex.DecodeString(tmpl.BlocktemplateBlob)
+	jobTarget, err := hex.DecodeString(jobData.Target)
 	if err != nil {
 		return
 	}
 
-	CurInfo.Lock()
-	CurInfo.SeedHash = tmpl.SeedHash
-	CurInfo.Difficulty = uint64(tmpl.Difficulty)
-	CurInfo.FutureHeight = uint64(tmpl.Height)
-	CurInfo.BlockReward = uint64(tmpl.ExpectedReward)
+	if len(jobTarget) == 4 {
+		logger.Dev("job target is 4-byte version")
+		jobDiff = template.ShortDiffToDiff(jobTarget)
+	} else {
+		logger.Dev("job target is 8-byte version")
+		jobDiff = template.MidDiffToDiff(jobTarget)
+	}
 
-	j = &template.Job{
-		Algo:     config.Cfg.AlgoName,
-		Blob:     tmpl.BlockhashingBlob,
-		Height:   CurInfo.Height,
-		JobID:    hex.EncodeToString(util.RandomBytes(8)),
-		SeedHash: tmpl.SeedHash,
-		Target:   template.DiffToShortTarget(jobDiff),
+	if jobDiff == 0 {
+		err = errors.New("jobDiff is zero")
+		return
 	}
 
-	CurInfo.Unlock()
+	cj.JobID = jobData.JobID
+	cj.Height = jobData.Height
+	cj.SeedHash = jobData.SeedHash
+	cj.NetDiff = template.NewWideDiff(uint64(jobData.NetworkDifficulty))
+	cj.Reward = uint64(jobData.Reward)
+
+	CurInfo.RLock()
+	cj.MajorVersion = CurInfo.MajorVersion
+	CurInfo.RUnlock()
 
 	return
 }
+
+func GetJob(jobDiff uint64) (j *template.Job, cj stratum.ConnJob, err error) {
+	tmpl, blocktemplateBlob, hashingBlob, err := NewBlobs()
+	if err != nil {
+		return
+	}
+
+	job := poolAlgo.Job(hex.EncodeToString(hashingBlob), hex.EncodeToString(util.RandomBytes(8)),
+		template.DiffToJobTarget(jobDiff), tmpl.Height, tmpl.SeedHash, tmpl.MajorVersion)
+	j = &job
+	cj = newConnJob(tmpl, j, blocktemplateBlob, hashingBlob, jobDiff)
+
+	return
+}
+
+// newConnJob returns the ConnJob for a job built from tmpl
+func newConnJob(tmpl *template.Template, j *template.Job, blob, hashingBlob []byte, jobDiff uint64) stratum.ConnJob {
+	return stratum.ConnJob{
+		Blob:         blob,
+		HashingBlob:  hashingBlob,
+		Diff:         jobDiff,
+		JobID:        j.JobID,
+		Height:       tmpl.Height,
+		SeedHash:     tmpl.SeedHash,
+		MajorVersion: tmpl.MajorVersion,
+		NetDiff:      tmpl.Difficulty,
+		Reward:       tmpl.Reward,
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"go-pool/config"
+	"testing"
+)
+
+func TestRequestedDiff(t *testing.T) {
+	config.SetSlaveSettings(config.SlaveSettings{MinDiff: 1000})
+	t.Cleanup(func() {
+		config.SetSlaveSettings(config.SlaveSettings{})
+		CurInfo.Difficulty = 0
+	})
+
+	tests := []struct {
+		name     string
+		netDiff  uint64 // 0 before the first template
+		listener config.ListenerConfig
+		diff     float64
+		expected uint64
+	}{
+		{"before the first template", 0, config.ListenerConfig{}, 50000, 50000},
+		{"before the first template, below min diff", 0, config.ListenerConfig{}, 10, 1000},
+		{"before the first template, max diff", 0, config.ListenerConfig{MaxDiff: 20000}, 50000, 20000},
+		{"network difficulty 1", 1, config.ListenerConfig{}, 50000, 50000},
+		{"below half the network difficulty", 200000, config.ListenerConfig{}, 50000, 50000},
+		{"above half the network difficulty", 60000, config.ListenerConfig{}, 50000, 30000},
+	}
+
+	for _, v := range tests {
+		CurInfo.Lock()
+		CurInfo.Difficulty = v.netDiff
+		CurInfo.Unlock()
+
+		if diff := requestedDiff(&v.listener, v.diff); diff != v.expected {
+			t.Errorf("%s: diff %d, expected %d", v.name, diff, v.expected)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"go-pool/config"
+	"go-pool/logger"
+	"go-pool/slave"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var startTime = time.Now()
+
+// shares since the slave started
+var numAccepted atomic.Uint64
+var numRejected atomic.Uint64
+
+// Heartbeat sends the slave status to the master every 10 seconds
+func Heartbeat() {
+	for {
+		time.Sleep(10 * time.Second)
+
+		h := slave.Heartbeat{
+			Name:       config.Cfg.SlaveConfig.Name,
+			Region:     config.Cfg.SlaveConfig.Region,
+			Version:    config.Version,
+			PublicHost: config.Cfg.SlaveConfig.PublicHost,
+			Accepted:   numAccepted.Load(),
+			Rejected:   numRejected.Load(),
+			Uptime:     uint64(time.Since(startTime).Seconds()),
+		}
+
+		h.Connections = uint32(srv.Conns.Len())
+
+		lim := srv.Limits.Stats()
+		logger.Debug("Connection limits: pending logins", lim.Pending, "refused (global)", lim.RefusedGlobal,
+			"refused (per IP)", lim.RefusedPerIP, "refused (pending logins)", lim.RefusedPending,
+			"login timeouts", lim.LoginTimeouts, "rate limited", lim.RateLimited, "slow consumers", lim.SlowConsumers)
+		h.RefusedConns = lim.RefusedGlobal + lim.RefusedPerIP + lim.RefusedPending
+		h.LoginTimeouts = lim.LoginTimeouts
+		h.RateLimited = lim.RateLimited
+		h.SlowConsumers = lim.SlowConsumers
+		h.BroadcastLatency = uint64(srv.BroadcastLatency().Microseconds())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		info, err := client.GetInfo(ctx)
+		cancel()
+		if err != nil {
+			logger.Warn("could not get daemon info:", err)
+		} else {
+			h.DaemonHeight = info.Height
+			h.DaemonSynced = info.Synchronized && !info.BusySyncing
+		}
+
+		st := GetVerifierStats()
+		logger.Debug("Share verification: queue depth", st.QueueDepth, "verified", st.Verified,
+			"rejected (queue full)", st.QueueFull, "avg latency", st.AvgLatency)
+		h.PowLatency = uint64(st.AvgLatency.Microseconds())
+
+		for _, v := range config.Cfg.SlaveConfig.GetListeners() {
+			_, port, err := net.SplitHostPort(v.Bind)
+			if err != nil {
+				continue
+			}
+			portNum, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				continue
+			}
+			h.Ports = append(h.Ports, slave.StratumPort{
+				Port:      uint16(portNum),
+				Tls:       v.Tls,
+				Desc:      v.Desc,
+				WebSocket: v.WebSocket,
+			})
+		}
+		if srv.Certs != nil {
+			h.TlsFingerprint = srv.Certs.Fingerprint()
+		}
+
+		slave.SendHeartbeat(&h)
+	}
+}
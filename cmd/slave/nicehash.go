@@ -17,104 +17,59 @@
 package main
 
 import (
-	"context"
 	"encoding/hex"
-	"go-pool/config"
 	"go-pool/logger"
+	"go-pool/stratum"
 	"go-pool/template"
 	"go-pool/util"
 	"sync"
-
-	"github.com/duggavo/go-monero/rpc/daemon"
 )
 
 type NicehashJob struct {
-	HashingBlob  []byte // the blockhashing blob
-	TemplateBlob []byte // the blocktemplate blob
-	Height       uint64 // only used in RandomX jobs
-	SeedHash     string // only used in RandomX jobs
+	HashingBlob  []byte             // the blockhashing blob
+	TemplateBlob []byte             // the blocktemplate blob
+	Template     *template.Template // the template the blobs are built from
 	LastNonce    byte
 }
 
 var CurrentNicehashJob NicehashJob
 var NicehashMutex sync.RWMutex
 
-func GetNicehashJob(jobDiff uint64) (j *template.Job, blocktemplateBlob []byte, nicehashByte byte, err error) {
+func GetNicehashJob(jobDiff uint64) (j *template.Job, cj stratum.ConnJob, err error) {
 	NicehashMutex.Lock()
 	defer NicehashMutex.Unlock()
 
 	if CurrentNicehashJob.LastNonce == 255 || CurrentNicehashJob.LastNonce == 0 {
 		logger.Debug("Generating new Nicehash Job")
 
-		var tmpl *daemon.GetBlockTemplateResult
-		tmpl, err = client.GetBlockTemplate(context.Background(), daemon.GetBlockTemplateParams{
-			WalletAddress: config.Cfg.PoolAddress,
-			ExtraNonce:    hex.EncodeToString(util.RandomBytes(8)),
-		})
-		if err != nil {
-			return
-		}
-
-		blocktemplateBlob, err = hex.DecodeString(tmpl.BlocktemplateBlob)
-		if err != nil {
-			return
-		}
-
-		CurInfo.Lock()
-		CurInfo.SeedHash = tmpl.SeedHash
-		CurInfo.Difficulty = uint64(tmpl.Difficulty)
-		CurInfo.FutureHeight = uint64(tmpl.Height)
-		CurInfo.BlockReward = uint64(tmpl.ExpectedReward)
-		CurInfo.Unlock()
-
-		var blobBin []byte
-		blobBin, err = hex.DecodeString(tmpl.BlockhashingBlob)
+		tmpl, blocktemplateBlob, blobBin, err := NewBlobs()
 		if err != nil {
-			return
+			return nil, cj, err
 		}
 
-		nhJob := NicehashJob{
+		CurrentNicehashJob = NicehashJob{
 			HashingBlob:  blobBin,
 			TemplateBlob: blocktemplateBlob,
-			Height:       tmpl.Height,
-			SeedHash:     tmpl.SeedHash,
+			Template:     tmpl,
 			LastNonce:    1,
 		}
-		CurrentNicehashJob = nhJob
-
-		blobBinNonce := blobBin
-
-		blobBinNonce[42] = 1
-		nicehashByte = 1
-
-		j = &template.Job{
-			Algo:     config.Cfg.AlgoName,
-			Blob:     hex.EncodeToString(blobBinNonce),
-			Height:   tmpl.Height,
-			JobID:    hex.EncodeToString(util.RandomBytes(8)),
-			SeedHash: tmpl.SeedHash,
-			Target:   template.DiffToShortTarget(jobDiff),
-		}
 	} else {
 		logger.Debug("Reusing Nicehash Job")
 
 		CurrentNicehashJob.LastNonce += 1
+	}
 
-		blobBinNonce := CurrentNicehashJob.HashingBlob
+	blobBinNonce := make([]byte, len(CurrentNicehashJob.HashingBlob))
+	copy(blobBinNonce, CurrentNicehashJob.HashingBlob)
+	blobBinNonce[poolAlgo.NicehashOffset()] = CurrentNicehashJob.LastNonce
 
-		blobBinNonce[42] = CurrentNicehashJob.LastNonce
-		nicehashByte = CurrentNicehashJob.LastNonce
-		blocktemplateBlob = CurrentNicehashJob.TemplateBlob
+	tmpl := CurrentNicehashJob.Template
 
-		j = &template.Job{
-			Algo:     config.Cfg.AlgoName,
-			Blob:     hex.EncodeToString(blobBinNonce),
-			Height:   CurrentNicehashJob.Height,
-			JobID:    hex.EncodeToString(util.RandomBytes(8)),
-			SeedHash: CurrentNicehashJob.SeedHash,
-			Target:   template.DiffToShortTarget(jobDiff),
-		}
-	}
+	job := poolAlgo.Job(hex.EncodeToString(blobBinNonce), hex.EncodeToString(util.RandomBytes(8)),
+		template.DiffToJobTarget(jobDiff), tmpl.Height, tmpl.SeedHash, tmpl.MajorVersion)
+	j = &job
+	cj = newConnJob(tmpl, j, CurrentNicehashJob.TemplateBlob, blobBinNonce, jobDiff)
+	cj.NicehashByte = CurrentNicehashJob.LastNonce
 
 	return
 }
@@ -0,0 +1,133 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"go-pool/config"
+	"go-pool/logger"
+	"go-pool/slave"
+	"go-pool/stratum"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_SHUTDOWN_GRACE = 30 // seconds
+
+// time the master has to acknowledge the last share batches
+const SHARE_ACK_TIMEOUT = 10 * time.Second
+
+// time the connection handlers have to return after the miners are disconnected
+const HANDLERS_TIMEOUT = 5 * time.Second
+
+// running connection handlers, waited for on shutdown so that the sessions of the miners are stored
+var handlers sync.WaitGroup
+
+// stopping is set when the slave starts shutting down. No handler is added after it, so that
+// handlers.Add doesn't race with handlers.Wait.
+var stopping bool
+var stoppingMut sync.Mutex
+
+// startHandler handles the connection in a new goroutine, or disconnects it if the slave is
+// shutting down
+func startHandler(conn *stratum.Connection) {
+	stoppingMut.Lock()
+	defer stoppingMut.Unlock()
+
+	if stopping {
+		srv.Kick(conn.Id)
+		return
+	}
+
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		HandleConnection(conn)
+	}()
+}
+
+// Shutdown waits for SIGTERM or SIGINT, then stops the slave gracefully: it stops accepting
+// connections, disconnects the miners gradually over the grace period, and sends the cached
+// shares to the master. A second signal stops the slave immediately.
+func Shutdown() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+
+	s := <-c
+	logger.Info("received", s.String()+", shutting down")
+	go func() {
+		s := <-c
+		logger.Warn("received", s.String()+" again, exiting now")
+		os.Exit(1)
+	}()
+
+	srv.Close()
+
+	stoppingMut.Lock()
+	stopping = true
+	stoppingMut.Unlock()
+
+	// the new slave, if any, loads the difficulties of the miners before they move to it
+	srv.Resume.Save()
+
+	grace := time.Duration(config.Cfg.SlaveConfig.ShutdownGrace) * time.Second
+	if config.Cfg.SlaveConfig.ShutdownGrace == 0 {
+		grace = DEFAULT_SHUTDOWN_GRACE * time.Second
+	} else if grace < 0 {
+		grace = 0
+	}
+	drain(grace)
+
+	done := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(HANDLERS_TIMEOUT):
+		logger.Warn("some connections did not close in time")
+	}
+
+	srv.Resume.Save()
+	err := srv.Bans.Save()
+	if err != nil {
+		logger.Error("could not save bans:", err)
+	}
+	slave.Shutdown(SHARE_ACK_TIMEOUT)
+
+	logger.Info("Slave stopped")
+	os.Exit(0)
+}
+
+// drain disconnects the miners evenly over the grace period, so that they don't all reconnect to
+// the other slaves at the same time
+func drain(grace time.Duration) {
+	conns := srv.Conns.All()
+	logger.Info("Disconnecting", len(conns), "miners in", grace)
+	if len(conns) == 0 {
+		return
+	}
+
+	interval := grace / time.Duration(len(conns))
+	for _, v := range conns {
+		srv.Kick(v.Id)
+		time.Sleep(interval)
+	}
+}
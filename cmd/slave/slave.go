@@ -18,11 +18,12 @@ package main
 
 import (
 	"context"
-	"encoding/hex"
+	"go-pool/algo"
 	"go-pool/config"
 	"go-pool/logger"
 	"go-pool/slave"
 	"go-pool/stratum"
+	"go-pool/template"
 	"os"
 	"os/signal"
 	"sync"
@@ -37,7 +38,7 @@ type Infos struct {
 	Height         uint64
 	FutureHeight   uint64
 	SeedHash       string
-	Difficulty     uint64
+	Difficulty     uint64 // the network difficulty, or math.MaxUint64 if it's wider
 	BlockReward    uint64
 	MajorVersion   uint
 	LastTemplateAt int64
@@ -104,14 +105,7 @@ func Refresher() {
 		}
 	}()
 
-	go func() {
-		for {
-			time.Sleep(10 * time.Second)
-			srv.ConnsMut.RLock()
-			slave.SendStats(len(srv.Connections))
-			srv.ConnsMut.RUnlock()
-		}
-	}()
+	go Heartbeat()
 	for {
 		CurInfo.RLock()
 		curHeight := CurInfo.Height
@@ -134,7 +128,7 @@ func Refresher() {
 		}
 
 		CurInfo.Lock()
-		if height.Height != CurInfo.Height || time.Now().Unix()-CurInfo.LastTemplateAt > int64(config.Cfg.SlaveConfig.TemplateTimeout) {
+		if height.Height != CurInfo.Height || time.Now().Unix()-CurInfo.LastTemplateAt > int64(config.GetSlaveSettings().TemplateTimeout) {
 			CurInfo.LastTemplateAt = time.Now().Unix()
 			if CurInfo.Height != height.Height {
 				logger.Debug("New height:", CurInfo.Height, "->", height.Height)
@@ -162,97 +156,128 @@ func Refresher() {
 	}
 }
 func OnNewBlock() {
-	srv.ConnsMut.Lock()
-	defer srv.ConnsMut.Unlock()
+	if !config.Cfg.UseP2Pool {
+		// a single template is used for all the jobs until the next refresh
+		err := UpdateTemplate()
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+		ClearNicehashJob()
+	}
 
-	for _, v := range srv.Connections {
-		c := v
-		go func() {
-			c.Lock()
-			defer c.Unlock()
+	if config.Cfg.UseP2Pool {
+		// the jobs are sent when P2Pool sends them
+		return
+	}
 
-			if config.Cfg.UseP2Pool {
-				// Do nothing
-			} else {
-				c.LastJob = c.CurrentJob
-
-				CurInfo.RLock()
-				// update difficulty
-				if c.NextDiff < float64(config.Cfg.SlaveConfig.MinDiff) {
-					c.NextDiff = float64(config.Cfg.SlaveConfig.MinDiff)
-				} else if c.NextDiff >= float64(CurInfo.Difficulty) {
-					c.NextDiff = float64(CurInfo.Difficulty - 1)
-				}
-				CurInfo.RUnlock()
-
-				c.CurrentJob.Diff = uint64(c.NextDiff)
-
-				if c.Nicehash {
-					// generate job & send job response
-					curJob, jobBlob, nicehashByte, err := GetNicehashJob(c.CurrentJob.Diff)
-					if err != nil {
-						logger.Error(err)
-						srv.Kick(c.Id)
-						return
-					}
-					c.CurrentJob.NicehashByte = nicehashByte
-					c.CurrentJob.Blob = jobBlob
-					c.CurrentJob.HashingBlob, err = hex.DecodeString(curJob.Blob)
-					if err != nil {
-						logger.Error(err)
-						srv.Kick(c.Id)
-						return
-					}
-					c.CurrentJob.JobID = curJob.JobID
-					jb := &stratum.JobNotification{
-						Jsonrpc: "2.0",
-						Method:  "job",
-						Params:  *curJob,
-					}
-					err = c.Send(jb)
-					if err != nil {
-						srv.Kick(c.Id)
-					}
-				} else {
-					// generate job & send job response
-					curJob, jobBlob, err := GetJob(c.CurrentJob.Diff)
-					if err != nil {
-						logger.Error(err)
-						srv.Kick(c.Id)
-						return
-					}
-					c.CurrentJob.Blob = jobBlob
-					c.CurrentJob.HashingBlob, err = hex.DecodeString(curJob.Blob)
-					if err != nil {
-						logger.Error(err)
-						srv.Kick(c.Id)
-						return
-					}
-					c.CurrentJob.JobID = curJob.JobID
-					jb := &stratum.JobNotification{
-						Jsonrpc: "2.0",
-						Method:  "job",
-						Params:  *curJob,
-					}
-					err = c.Send(jb)
-					if err != nil {
-						srv.Kick(c.Id)
-					}
-				}
-			}
-		}()
+	latency := srv.Broadcast(func(c *stratum.Connection) {
+		err := sendJob(c)
+		if err != nil {
+			logger.Debug("could not send job:", err)
+			c.Close()
+		}
+	})
+	logger.Debug("Sent new jobs in", latency)
+}
+
+// sendJob sends a new job, at the current target difficulty, to the connection.
+// Connection must be locked.
+func sendJob(c *stratum.Connection) error {
+	curJob, err := newJob(c)
+	if err != nil {
+		return err
 	}
 
-	go func() {
-		time.Sleep(time.Second)
-		ClearNicehashJob()
-	}()
+	jb := &stratum.JobNotification{
+		Jsonrpc: "2.0",
+		Method:  "job",
+		Params:  *curJob,
+	}
+	return c.Send(jb)
+}
+
+// newJob makes a new job, at the current target difficulty, the current job of the connection.
+// Connection must be locked.
+func newJob(c *stratum.Connection) (*template.Job, error) {
+	// update difficulty
+	c.NextDiff = limitDiff(c.Listener, c.NextDiff)
+	CurInfo.RLock()
+	// the difficulty is 0 until the first template is fetched
+	if CurInfo.Difficulty > 1 && c.NextDiff >= float64(CurInfo.Difficulty) {
+		c.NextDiff = float64(CurInfo.Difficulty - 1)
+	}
+	CurInfo.RUnlock()
+
+	// generate job & send job response
+	var curJob *template.Job
+	var connJob stratum.ConnJob
+	var err error
+	if c.Nicehash {
+		curJob, connJob, err = GetNicehashJob(uint64(c.NextDiff))
+	} else {
+		curJob, connJob, err = GetJob(uint64(c.NextDiff))
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.PushJob(connJob)
+
+	return curJob, nil
+}
+
+// ReloadCertificates reloads the TLS certificates on SIGHUP
+func ReloadCertificates(certs *stratum.CertStore) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		logger.Info("received SIGHUP, reloading TLS certificates")
+		err := certs.Reload()
+		if err != nil {
+			logger.Error("could not reload TLS certificates:", err)
+		}
+	}
 }
 
+// miner difficulties and trust scores, see stratum.ResumeCache
+const RESUME_FILE = "resume.json"
+
 var client *daemon.Client
 var srv *stratum.Server
+var poolAlgo *algo.Algo
 
 func main() {
+	config.Load()
+	logger.LogLevel = config.Cfg.LogLevel
+
+	if len(os.Args) > 1 && os.Args[1] == "ban" {
+		BanCommand(os.Args[2:])
+		return
+	}
+
+	var err error
+	poolAlgo, err = algo.Get(config.Cfg.AlgoName)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Info("Mining algorithm", poolAlgo.Name)
+
+	bans, err := stratum.NewBanManager(BANS_FILE, config.Cfg.SlaveConfig.Bans)
+	if err != nil {
+		logger.Fatal("could not load bans:", err)
+	}
+	go bans.Run()
+
+	resume, err := stratum.NewResumeCache(RESUME_FILE, config.Cfg.SlaveConfig.Resume)
+	if err != nil {
+		logger.Fatal("could not load resume cache:", err)
+	}
+	if resume != nil {
+		logger.Info("Loaded", resume.Len(), "miner sessions")
+		go resume.Run()
+	}
+
 	go slave.StartSlaveClient()
 
 	rpcClient, err := rpc.NewClient(config.Cfg.DaemonRpc)
@@ -263,14 +288,44 @@ func main() {
 
 	logger.Info("Using daemon RPC " + config.Cfg.DaemonRpc)
 
+	StartVerifiers()
+
+	vardiff, err := stratum.NewVardiff(config.Cfg.SlaveConfig.Vardiff)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	var certs *stratum.CertStore
+	for _, v := range config.Cfg.SlaveConfig.GetListeners() {
+		if v.Tls {
+			certs, err = stratum.NewCertStore(config.Cfg.SlaveConfig.Tls)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			go certs.Run()
+			go ReloadCertificates(certs)
+			break
+		}
+	}
+
+	srv = &stratum.Server{
+		Certs:           certs,
+		Bans:            bans,
+		Resume:          resume,
+		Limits:          stratum.NewLimiter(config.Cfg.SlaveConfig.Limits),
+		Vardiff:         vardiff,
+		RetargetPercent: config.Cfg.SlaveConfig.Vardiff.RetargetPercent,
+	}
+
+	// the new blocks are broadcast to srv
 	go Refresher()
 
-	srv = &stratum.Server{}
-	go srv.Start(config.Cfg.SlaveConfig.PoolPort, config.Cfg.SlaveConfig.PoolPortTls)
+	go srv.Start(config.Cfg.SlaveConfig.GetListeners())
+	go Shutdown()
 
 	time.Sleep(time.Second)
 	for {
 		conn := <-srv.NewConnections
-		go HandleConnection(conn)
+		startHandler(conn)
 	}
 }
@@ -0,0 +1,127 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"go-pool/config"
+	"go-pool/logger"
+	"sync/atomic"
+	"time"
+
+	"github.com/duggavo/go-monero/rpc/daemon"
+)
+
+const DEFAULT_POW_VERIFIERS = 4
+const DEFAULT_POW_QUEUE_SIZE = 256
+
+var ErrQueueFull = errors.New("share verification queue is full")
+
+type powRequest struct {
+	Params   daemon.CalcPowParameters
+	QueuedAt time.Time
+	Result   chan powResult
+}
+type powResult struct {
+	Hash string
+	Err  error
+}
+
+var powQueue chan *powRequest
+
+// verification metrics, reset by GetVerifierStats
+var numVerified atomic.Uint64
+var numQueueFull atomic.Uint64
+var totalLatency atomic.Int64 // in microseconds, from queueing to result
+
+type VerifierStats struct {
+	QueueDepth int
+	Verified   uint64
+	QueueFull  uint64
+	AvgLatency time.Duration
+}
+
+// StartVerifiers starts the pool of goroutines that check share PoW with the daemon
+func StartVerifiers() {
+	numVerifiers := config.Cfg.SlaveConfig.PowVerifiers
+	if numVerifiers <= 0 {
+		numVerifiers = DEFAULT_POW_VERIFIERS
+	}
+	queueSize := config.Cfg.SlaveConfig.PowQueueSize
+	if queueSize <= 0 {
+		queueSize = DEFAULT_POW_QUEUE_SIZE
+	}
+
+	powQueue = make(chan *powRequest, queueSize)
+
+	logger.Info("Starting", numVerifiers, "share verifiers, queue size", queueSize)
+
+	for i := 0; i < numVerifiers; i++ {
+		go func() {
+			for req := range powQueue {
+				ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+				hash, err := client.CalcPow(ctx, req.Params)
+				cancel()
+
+				numVerified.Add(1)
+				totalLatency.Add(time.Since(req.QueuedAt).Microseconds())
+
+				req.Result <- powResult{
+					Hash: hash,
+					Err:  err,
+				}
+			}
+		}()
+	}
+}
+
+// VerifyPow queues the PoW calculation and waits for its result.
+// If the queue is full, ErrQueueFull is returned immediately.
+func VerifyPow(params daemon.CalcPowParameters) (string, error) {
+	req := &powRequest{
+		Params:   params,
+		QueuedAt: time.Now(),
+		Result:   make(chan powResult, 1),
+	}
+
+	select {
+	case powQueue <- req:
+	default:
+		numQueueFull.Add(1)
+		return "", ErrQueueFull
+	}
+
+	res := <-req.Result
+	return res.Hash, res.Err
+}
+
+// GetVerifierStats returns the verifier metrics since the last call
+func GetVerifierStats() VerifierStats {
+	verified := numVerified.Swap(0)
+	latency := totalLatency.Swap(0)
+
+	st := VerifierStats{
+		QueueDepth: len(powQueue),
+		Verified:   verified,
+		QueueFull:  numQueueFull.Swap(0),
+	}
+	if verified != 0 {
+		st.AvgLatency = time.Duration(latency/int64(verified)) * time.Microsecond
+	}
+	return st
+}
@@ -23,18 +23,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 )
 
 const MAX_REQUEST_SIZE = 5 * 1024 // 5 MiB
 
 var Cfg Config
 
-func init() {
-	fd, err := os.ReadFile("config.json")
+// Load reads config.json into Cfg, and creates a blank configuration if there is none. It's
+// called first by the master and the slave; tests set Cfg directly.
+func Load() {
+	_, err := os.Stat("config.json")
 	if err != nil {
 		fmt.Println(err)
 
-		fd, err = os.ReadFile("../config.json")
+		_, err = os.Stat("../config.json")
 		if err != nil {
 			blankCfg, err := json.MarshalIndent(Config{}, "", "\t")
 
@@ -48,7 +51,7 @@ func init() {
 		}
 	}
 
-	err = json.Unmarshal(fd, &Cfg)
+	Cfg, err = Read()
 	if err != nil {
 		panic(err)
 	}
@@ -59,6 +62,26 @@ func init() {
 
 }
 
+// Read reads the configuration file, without applying it
+func Read() (Config, error) {
+	var cfg Config
+
+	fd, err := os.ReadFile("config.json")
+	if err != nil {
+		fd, err = os.ReadFile("../config.json")
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	err = json.Unmarshal(fd, &cfg)
+	return cfg, err
+}
+
+// Version of the pool software, reported by the slaves to the master.
+// Can be set at build time with -ldflags "-X go-pool/config.Version=..."
+var Version = "dev"
+
 var MasterPass [32]byte
 var BlockTime uint64
 
@@ -96,23 +119,174 @@ type MasterConfig struct {
 	MinWithdrawal    float64       `json:"min_withdrawal"`
 	WithdrawInterval int64         `json:"withdrawal_interval_minutes"`
 	Stratums         []StratumAddr `json:"stratums"`
+
+	// IPs or CIDR ranges of the proxies allowed to send a PROXY protocol header to the API
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// Access to the operator-only API endpoints (/slaves, and the stats of the pool address):
+	// requests with the header "Authorization: Bearer <OperatorToken>", or from OperatorIPs (IPs or
+	// CIDR ranges). If both are empty, only the loopback IPs are allowed.
+	OperatorToken string   `json:"operator_token"`
+	OperatorIPs   []string `json:"operator_ips"`
+
+	// Slaves allowed to connect to the master
+	Slaves []SlaveIdentity `json:"slaves"`
 }
 type SlaveConfig struct {
-	MasterAddress string `json:"master_address"`
+	MasterAddress   string `json:"master_address"`
+	MasterPublicKey string `json:"master_public_key"` // printed by the master on startup
 
+	// reported to the master, and published in the stratum list of the API
+	Name       string `json:"name"`
+	Region     string `json:"region"`
+	PublicHost string `json:"public_host"` // hostname miners connect to. If empty, the master uses the slave IP
+
+	// MinDiff, ShareTargetTime, TrustScore, TemplateTimeout and SlaveFee are pushed by the master,
+	// and can be changed at runtime. Read them with GetSlaveSettings.
 	MinDiff         uint64 `json:"min_diff"`
 	ShareTargetTime uint64 `json:"share_target_time"`
 	TrustScore      uint64 `json:"trust_score"`
 
+	// used if there are no listeners
 	PoolPort    uint16 `json:"pool_port"`
 	PoolPortTls uint16 `json:"pool_port_tls"`
 
+	Listeners []ListenerConfig `json:"listeners"`
+
+	// IPs or CIDR ranges of the proxies allowed to send a PROXY protocol header
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// lets a new slave listen on the same ports while the old one shuts down, for upgrades
+	// without downtime. Only supported on Linux and the BSDs.
+	ReusePort bool `json:"reuse_port"`
+
+	// seconds given to the miners to move to another slave on shutdown, before they are
+	// disconnected. Negative values disconnect them immediately.
+	ShutdownGrace int `json:"shutdown_grace"`
+
+	Tls TlsConfig `json:"tls"`
+
 	TemplateTimeout int     `json:"template_timeout"`
 	SlaveFee        float64 `json:"slave_fee"`
+
+	PowVerifiers int `json:"pow_verifiers"`  // number of concurrent calc_pow calls to the daemon
+	PowQueueSize int `json:"pow_queue_size"` // shares waiting for verification; more are rejected
+
+	Bans    BanConfig     `json:"bans"`
+	Limits  LimitsConfig  `json:"limits"`
+	Vardiff VardiffConfig `json:"vardiff"`
+	Resume  ResumeConfig  `json:"resume"`
+}
+
+// TLS settings of the stratum server. Zero values use the defaults.
+type TlsConfig struct {
+	CertFile string `json:"cert_file"` // generated if it doesn't exist
+	KeyFile  string `json:"key_file"`
+
+	// additional certificates, chosen with the SNI sent by the miner
+	Sni []TlsCertificate `json:"sni"`
+
+	MinVersion string `json:"min_version"` // "1.2" or "1.3"
+}
+
+type TlsCertificate struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// Vardiff settings. Zero values use the defaults.
+type VardiffConfig struct {
+	Algorithm  string `json:"algorithm"`   // "default" or "window"
+	WindowSize int    `json:"window_size"` // shares used by the window algorithm
+
+	// a new job is sent as soon as the target difficulty differs from the difficulty of the
+	// current job by this percentage. Negative values disable it.
+	RetargetPercent float64 `json:"retarget_percent"`
+}
+
+// Session resumption. Zero values use the defaults.
+type ResumeConfig struct {
+	// seconds the difficulty, trust score and NiceHash mode of a miner are remembered after it
+	// disconnects. Negative values disable it.
+	Window int64 `json:"window"`
+}
+
+// Limits of the stratum server. Zero values use the defaults.
+type LimitsConfig struct {
+	MaxConns         int     `json:"max_conns"`
+	MaxConnsPerIP    int     `json:"max_conns_per_ip"`
+	MaxPendingLogins int     `json:"max_pending_logins"` // connections that haven't sent their login yet
+	LoginTimeout     int     `json:"login_timeout"`      // seconds a connection has to send its login
+	RequestRate      float64 `json:"request_rate"`       // submits and keepalives per second for each connection
+	RequestBurst     int     `json:"request_burst"`
+}
+
+// ListenerConfig is a stratum port, with its difficulty profile
+type ListenerConfig struct {
+	Bind      string `json:"bind"` // for example "0.0.0.0:3333" or "[::]:3333"
+	Tls       bool   `json:"tls"`
+	WebSocket bool   `json:"websocket"` // stratum messages over WebSocket, for browser miners
+	Desc      string `json:"desc"`
+
+	// Origins of the web pages allowed to connect to a WebSocket listener, for example
+	// "https://example.com", or "*" for any. Stratum miners don't send an Origin, and are always
+	// allowed; browsers are refused if this is empty.
+	Origins []string `json:"origins"`
+
+	// zero values use the global settings
+	StartDiff uint64 `json:"start_diff"`
+	MinDiff   uint64 `json:"min_diff"`
+	MaxDiff   uint64 `json:"max_diff"`
+
+	FixedDiff uint64 `json:"fixed_diff"` // if not zero, vardiff and custom diffs are disabled
+}
+
+// GetListeners returns the configured listeners, or the listeners on pool_port and pool_port_tls
+func (c *SlaveConfig) GetListeners() []ListenerConfig {
+	if len(c.Listeners) != 0 {
+		return c.Listeners
+	}
+
+	var l []ListenerConfig
+	if c.PoolPort != 0 {
+		l = append(l, ListenerConfig{
+			Bind: "0.0.0.0:" + strconv.FormatUint(uint64(c.PoolPort), 10),
+		})
+	}
+	if c.PoolPortTls != 0 {
+		l = append(l, ListenerConfig{
+			Bind: "0.0.0.0:" + strconv.FormatUint(uint64(c.PoolPortTls), 10),
+			Tls:  true,
+		})
+	}
+	return l
+}
+
+// Thresholds of the automatic bans. Zero values use the defaults.
+// Bans added by the operator are enforced even if automatic bans are disabled.
+type BanConfig struct {
+	Enabled        bool    `json:"enabled"`
+	BanTime        int64   `json:"ban_time"`        // in seconds
+	InvalidPercent float64 `json:"invalid_percent"` // ban when this percentage of the shares is invalid
+	CheckThreshold uint32  `json:"check_threshold"` // number of shares before the invalid percentage is checked
+	MalformedLimit uint32  `json:"malformed_limit"` // malformed requests allowed every 10 minutes
+	LoginLimit     uint32  `json:"login_limit"`     // connections allowed from an IP every minute, besides max_conns_per_ip
+
+	// also ban the payout address of the miners with too many invalid shares. Anyone can submit
+	// shares for any address, so this allows attackers to get other addresses banned.
+	BanAddresses bool `json:"ban_addresses"`
+}
+
+type SlaveIdentity struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"` // printed by the slave on startup
 }
 
 type StratumAddr struct {
 	Addr string `json:"addr"`
 	Desc string `json:"desc"`
 	Tls  bool   `json:"tls"`
+
+	WebSocket      bool   `json:"websocket,omitempty"`
+	TlsFingerprint string `json:"tls_fingerprint,omitempty"` // SHA-256 of the certificate, as used by XMRig --tls-fingerprint
 }
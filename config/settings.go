@@ -0,0 +1,108 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"errors"
+	"go-pool/serializer"
+	"math"
+	"sync"
+)
+
+// SlaveSettings are the slave settings that can be changed at runtime.
+// The master pushes its own to the slaves on connection and when they are reloaded.
+type SlaveSettings struct {
+	MinDiff         uint64
+	ShareTargetTime uint64
+	TrustScore      uint64
+	TemplateTimeout int
+	SlaveFee        float64
+}
+
+var settingsMut sync.RWMutex
+
+// GetSlaveSettings returns the current runtime settings.
+// Always use it instead of reading the fields of Cfg.SlaveConfig directly.
+func GetSlaveSettings() SlaveSettings {
+	settingsMut.RLock()
+	defer settingsMut.RUnlock()
+
+	return Cfg.SlaveConfig.Settings()
+}
+
+func SetSlaveSettings(s SlaveSettings) {
+	settingsMut.Lock()
+	defer settingsMut.Unlock()
+
+	Cfg.SlaveConfig.MinDiff = s.MinDiff
+	Cfg.SlaveConfig.ShareTargetTime = s.ShareTargetTime
+	Cfg.SlaveConfig.TrustScore = s.TrustScore
+	Cfg.SlaveConfig.TemplateTimeout = s.TemplateTimeout
+	Cfg.SlaveConfig.SlaveFee = s.SlaveFee
+}
+
+func (c *SlaveConfig) Settings() SlaveSettings {
+	return SlaveSettings{
+		MinDiff:         c.MinDiff,
+		ShareTargetTime: c.ShareTargetTime,
+		TrustScore:      c.TrustScore,
+		TemplateTimeout: c.TemplateTimeout,
+		SlaveFee:        c.SlaveFee,
+	}
+}
+
+func (s *SlaveSettings) Validate() error {
+	if s.MinDiff == 0 {
+		return errors.New("min_diff must not be zero")
+	}
+	if s.ShareTargetTime == 0 {
+		return errors.New("share_target_time must not be zero")
+	}
+	if s.TemplateTimeout <= 0 {
+		return errors.New("template_timeout must be positive")
+	}
+	if s.SlaveFee < 0 || s.SlaveFee > 100 {
+		return errors.New("slave_fee must be between 0 and 100")
+	}
+	return nil
+}
+
+func (s *SlaveSettings) Serialize() []byte {
+	x := serializer.Serializer{}
+
+	x.AddUvarint(s.MinDiff)
+	x.AddUvarint(s.ShareTargetTime)
+	x.AddUvarint(s.TrustScore)
+	x.AddUvarint(uint64(s.TemplateTimeout))
+	x.AddUint64(math.Float64bits(s.SlaveFee))
+
+	return x.Data
+}
+func (s *SlaveSettings) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	s.MinDiff = d.ReadUvarint()
+	s.ShareTargetTime = d.ReadUvarint()
+	s.TrustScore = d.ReadUvarint()
+	s.TemplateTimeout = int(d.ReadUvarint())
+	s.SlaveFee = math.Float64frombits(d.ReadUint64())
+
+	return d.Error
+}
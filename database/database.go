@@ -17,7 +17,10 @@
 
 package database
 
-import "go-pool/serializer"
+import (
+	"fmt"
+	"go-pool/serializer"
+)
 
 type Share struct {
 	Wallet string `json:"wall"`
@@ -52,6 +55,76 @@ func (x *Share) Deserialize(data []byte) error {
 	return d.Error
 }
 
+// BatchShare is the aggregation of the shares of a wallet in a ShareBatch
+type BatchShare struct {
+	Wallet string
+	Worker string
+	Count  uint32
+	Diff   uint64
+}
+
+// version 1 added worker names
+const BATCH_VERSION = 1
+
+// ShareBatch is a batch of shares sent by a slave to the master
+type ShareBatch struct {
+	Spool  uint64 // random id of the slave's spool
+	ID     uint64 // incremented for each batch of the spool
+	Time   uint64 // when the shares were found
+	Shares []BatchShare
+}
+
+func (x *ShareBatch) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(BATCH_VERSION)
+
+	s.AddUint64(x.Spool)
+	s.AddUvarint(x.ID)
+	s.AddUvarint(x.Time)
+
+	s.AddUvarint(uint64(len(x.Shares)))
+	for _, v := range x.Shares {
+		s.AddString(v.Wallet)
+		s.AddString(v.Worker)
+		s.AddUvarint(uint64(v.Count))
+		s.AddUvarint(v.Diff)
+	}
+
+	return s.Data
+}
+func (x *ShareBatch) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	version := d.ReadUint8()
+
+	x.Spool = d.ReadUint64()
+	x.ID = d.ReadUvarint()
+	x.Time = d.ReadUvarint()
+
+	numShares := d.ReadUvarint()
+	if d.Error == nil && numShares > uint64(len(d.Data)) {
+		return fmt.Errorf("invalid number of shares %d", numShares)
+	}
+
+	x.Shares = make([]BatchShare, 0, numShares)
+	for i := uint64(0); i < numShares && d.Error == nil; i++ {
+		var sh BatchShare
+		sh.Wallet = d.ReadString()
+		if version >= 1 {
+			sh.Worker = d.ReadString()
+		}
+		sh.Count = uint32(d.ReadUvarint())
+		sh.Diff = d.ReadUvarint()
+
+		x.Shares = append(x.Shares, sh)
+	}
+
+	return d.Error
+}
+
 type UnconfTx struct {
 	UnlockHeight uint64
 	TxnHash      [32]byte
@@ -180,10 +253,12 @@ database structure:
 
 addressInfo: address -> address data
 shares: share id -> share data
+batchIds: slave name + spool id + "/" + batch id -> time the batch was stored
 */
 
 var (
 	ADDRESS_INFO = []byte("a") // address -> address data
 	SHARES       = []byte("s") // share id -> share data
 	PENDING      = []byte("p") // "pending" -> pending balances
+	BATCH_IDS    = []byte("i") // slave name + spool id + "/" + batch id -> time the batch was stored
 )
@@ -19,7 +19,6 @@ package logger
 
 import (
 	"fmt"
-	"go-pool/config"
 	"os"
 	"runtime"
 	"strconv"
@@ -27,7 +26,8 @@ import (
 	"time"
 )
 
-var LogLevel = config.Cfg.LogLevel
+// LogLevel is set from the configuration on startup
+var LogLevel uint8
 
 var Reset = "\033[0m"
 var Red = "\033[31m"
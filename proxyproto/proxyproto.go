@@ -0,0 +1,317 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package proxyproto implements the PROXY protocol (v1 and v2) used by HAProxy and nginx to pass
+// the address of the client to the server.
+// Headers are only accepted from trusted proxies; other peers are seen as-is.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-pool/logger"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const HEADER_TIMEOUT = 10 * time.Second
+
+// the longest v1 header is 107 bytes
+const MAX_V1_LENGTH = 107
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// Listener wraps a net.Listener, reading the PROXY protocol header of the connections from the
+// trusted proxies. Headers are read in the background, so a slow proxy doesn't block Accept.
+type Listener struct {
+	net.Listener
+
+	trusted []*net.IPNet
+	conns   chan net.Conn
+	errs    chan error
+
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+// Conn is a connection that came through a proxy
+type Conn struct {
+	net.Conn
+
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the address of the client, as reported by the proxy
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ParseTrusted parses a list of IPs and CIDR ranges
+func ParseTrusted(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP or CIDR range %s", v)
+			}
+			if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR range %s: %w", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// NewListener wraps l. If trusted is empty, l is returned unchanged.
+func NewListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	if len(trusted) == 0 {
+		return l
+	}
+
+	pl := &Listener{
+		Listener: l,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go pl.run()
+
+	return pl
+}
+
+func (l *Listener) run() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		if !l.isTrusted(c.RemoteAddr()) {
+			l.send(c)
+			continue
+		}
+
+		go func() {
+			pc, err := readHeader(c)
+			if err != nil {
+				logger.Warn("proxy", c.RemoteAddr().String(), "sent an invalid PROXY header:", err)
+				c.Close()
+				return
+			}
+			l.send(pc)
+		}()
+	}
+}
+
+// send passes the connection to Accept, or closes it if the listener is closed
+func (l *Listener) send(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener, and the connections whose header is being read
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, v := range l.trusted {
+		if v.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func readHeader(c net.Conn) (*Conn, error) {
+	c.SetReadDeadline(time.Now().Add(HEADER_TIMEOUT))
+	defer c.SetReadDeadline(time.Time{})
+
+	pc := &Conn{
+		Conn:   c,
+		reader: bufio.NewReader(c),
+		remote: c.RemoteAddr(),
+	}
+
+	start, err := pc.reader.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	if bytes.Equal(start, v2Signature) {
+		remote, err = readV2(pc.reader)
+	} else if bytes.HasPrefix(start, []byte("PROXY ")) {
+		remote, err = readV1(pc.reader)
+	} else {
+		err = ErrInvalidHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// LOCAL and UNKNOWN headers keep the address of the proxy
+	if remote != nil {
+		pc.remote = remote
+	}
+	return pc, nil
+}
+
+// readV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 3333\r\n"
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < MAX_V1_LENGTH {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("%w: invalid source address", ErrInvalidHeader)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid source port", ErrInvalidHeader)
+	}
+
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(port),
+	}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	verCmd := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, verCmd>>4)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0xf {
+	case 0: // LOCAL, e.g. health checks of the proxy
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidHeader, verCmd&0xf)
+	}
+
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(data) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(data[0:4]),
+			Port: int(binary.BigEndian.Uint16(data[8:10])),
+		}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(data) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(data[0:16]),
+			Port: int(binary.BigEndian.Uint16(data[32:34])),
+		}, nil
+	default:
+		// unspecified or unix sockets
+		return nil, nil
+	}
+}
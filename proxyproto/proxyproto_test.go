@@ -0,0 +1,103 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) (net.Listener, string) {
+	trusted, err := ParseTrusted([]string{"127.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(l, trusted)
+	t.Cleanup(func() { pl.Close() })
+	return pl, l.Addr().String()
+}
+
+func TestListener(t *testing.T) {
+	l, addr := listen(t)
+
+	go func() {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 203.0.113.5 192.0.2.1 4567 3333\r\nhello"))
+		io.Copy(io.Discard, c)
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.RemoteAddr().String() != "203.0.113.5:4567" {
+		t.Fatalf("remote address %s", c.RemoteAddr())
+	}
+	b := make([]byte, 5)
+	_, err = io.ReadFull(c, b)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	for _, v := range []string{"1.2.3", "1.2.3.4/33", "example.com"} {
+		if _, err := ParseTrusted([]string{v}); err == nil {
+			t.Errorf("%s accepted", v)
+		}
+	}
+}
+
+// the connections whose header is read after Close are closed, instead of waiting for Accept
+func TestCloseMidHeader(t *testing.T) {
+	l, addr := listen(t)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the connection is accepted by the listener, but its header is not sent yet
+	time.Sleep(50 * time.Millisecond)
+	l.Close()
+
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept returned %v after Close", err)
+	}
+
+	c.Write([]byte("PROXY TCP4 203.0.113.5 192.0.2.1 4567 3333\r\n"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("the connection was not closed: %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package session implements the encrypted link between the slaves and the master.
+//
+// Each side has a static X25519 keypair. The slave knows the master's public key, and the master
+// only accepts the slave public keys in its allowlist. On connection, both sides exchange ephemeral
+// keys, and derive the session keys from the four Diffie-Hellman combinations of the static and
+// ephemeral keys, mixed with the pre-shared master password.
+// Compromising the static keys does not reveal the traffic of past sessions.
+//
+// Frames are sealed with ChaCha20-Poly1305, using a per-direction frame counter as nonce.
+// Replayed, reordered or dropped frames fail to decrypt, and the session is closed.
+package session
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const Overhead = chacha20poly1305.Overhead
+
+const KEY_SIZE = 32
+
+const HANDSHAKE_TIMEOUT = 15 * time.Second
+const WRITE_TIMEOUT = 30 * time.Second
+
+var handshakeInfo = []byte("go-pool master link v1")
+
+var ErrNotAllowed = errors.New("remote key is not allowed")
+
+type Session struct {
+	Conn      net.Conn
+	RemoteKey *ecdh.PublicKey // static public key of the other side
+
+	sendAead    cipher.AEAD
+	recvAead    cipher.AEAD
+	sendCounter uint64
+	recvCounter uint64
+
+	sendMut sync.Mutex
+}
+
+// LoadKey reads the hex-encoded static private key at path. If the file doesn't exist,
+// a new key is generated and saved.
+func LoadKey(path string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return key, os.WriteFile(path, []byte(hex.EncodeToString(key.Bytes())), 0o600)
+	} else if err != nil {
+		return nil, err
+	}
+
+	keyBin, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(keyBin)
+}
+
+// ParsePublicKey parses a hex-encoded public key
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	keyBin, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(keyBin)
+}
+
+func PublicKeyString(key *ecdh.PublicKey) string {
+	return hex.EncodeToString(key.Bytes())
+}
+
+// Dial performs the handshake as the slave. remoteKey is the master's static public key.
+func Dial(conn net.Conn, key *ecdh.PrivateKey, remoteKey *ecdh.PublicKey, psk []byte) (*Session, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := make([]byte, 0, 2*KEY_SIZE)
+	hello = append(hello, ephemeral.PublicKey().Bytes()...)
+	hello = append(hello, key.PublicKey().Bytes()...)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, KEY_SIZE)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		Conn:      conn,
+		RemoteKey: remoteKey,
+	}
+	err = s.deriveKeys(false, ephemeral, key, remoteEphemeral, remoteKey, psk)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept performs the handshake as the master. If isAllowed returns false for the slave's
+// static public key, ErrNotAllowed is returned.
+func Accept(conn net.Conn, key *ecdh.PrivateKey, psk []byte, isAllowed func(*ecdh.PublicKey) bool) (*Session, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, 2*KEY_SIZE)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, err
+	}
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(hello[:KEY_SIZE])
+	if err != nil {
+		return nil, err
+	}
+	remoteKey, err := ecdh.X25519().NewPublicKey(hello[KEY_SIZE:])
+	if err != nil {
+		return nil, err
+	}
+	if !isAllowed(remoteKey) {
+		return nil, fmt.Errorf("%w: %s", ErrNotAllowed, PublicKeyString(remoteKey))
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(ephemeral.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		Conn:      conn,
+		RemoteKey: remoteKey,
+	}
+	err = s.deriveKeys(true, ephemeral, key, remoteEphemeral, remoteKey, psk)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) deriveKeys(isMaster bool, ephemeral, static *ecdh.PrivateKey,
+	remoteEphemeral, remoteStatic *ecdh.PublicKey, psk []byte) error {
+
+	// keys are ordered as slave, master
+	slaveEph, slaveStatic := ephemeral.PublicKey(), static.PublicKey()
+	masterEph, masterStatic := remoteEphemeral, remoteStatic
+	if isMaster {
+		slaveEph, slaveStatic, masterEph, masterStatic = masterEph, masterStatic, slaveEph, slaveStatic
+	}
+
+	var secrets [][]byte
+	for _, v := range []struct {
+		priv *ecdh.PrivateKey
+		pub  *ecdh.PublicKey
+	}{
+		{ephemeral, remoteEphemeral}, // ee
+		{ephemeral, remoteStatic},    // es (se on the master)
+		{static, remoteEphemeral},    // se (es on the master)
+		{static, remoteStatic},       // ss
+	} {
+		secret, err := v.priv.ECDH(v.pub)
+		if err != nil {
+			return err
+		}
+		secrets = append(secrets, secret)
+	}
+	if isMaster {
+		secrets[1], secrets[2] = secrets[2], secrets[1]
+	}
+
+	transcript := sha256.New()
+	transcript.Write(slaveEph.Bytes())
+	transcript.Write(slaveStatic.Bytes())
+	transcript.Write(masterEph.Bytes())
+	transcript.Write(masterStatic.Bytes())
+
+	ikm := bytes.Join(append(secrets, psk), nil)
+
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, ikm, transcript.Sum(nil), handshakeInfo), keys)
+	if err != nil {
+		return err
+	}
+
+	slaveToMaster, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return err
+	}
+	masterToSlave, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return err
+	}
+
+	if isMaster {
+		s.sendAead, s.recvAead = masterToSlave, slaveToMaster
+	} else {
+		s.sendAead, s.recvAead = slaveToMaster, masterToSlave
+	}
+	return nil
+}
+
+func counterNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], counter)
+	return nonce
+}
+
+func (s *Session) seal(msg []byte) []byte {
+	out := s.sendAead.Seal(nil, counterNonce(s.sendCounter), msg, nil)
+	s.sendCounter++
+	return out
+}
+func (s *Session) open(msg []byte) ([]byte, error) {
+	out, err := s.recvAead.Open(nil, counterNonce(s.recvCounter), msg, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid frame %d: %w", s.recvCounter, err)
+	}
+	s.recvCounter++
+	return out, nil
+}
+
+// Write sends a frame. It can be called concurrently.
+func (s *Session) Write(data []byte) error {
+	if len(data) > math.MaxUint16 {
+		return fmt.Errorf("frame too long: %d bytes", len(data))
+	}
+
+	s.sendMut.Lock()
+	defer s.sendMut.Unlock()
+
+	if s.sendCounter == math.MaxUint64 {
+		return errors.New("frame counter exhausted")
+	}
+
+	var dataLenBin = make([]byte, 0, 2)
+	dataLenBin = binary.LittleEndian.AppendUint16(dataLenBin, uint16(len(data)))
+
+	frame := s.seal(dataLenBin)
+	frame = append(frame, s.seal(data)...)
+
+	s.Conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	_, err := s.Conn.Write(frame)
+	return err
+}
+
+// Read reads the next frame. It must not be called concurrently.
+func (s *Session) Read() ([]byte, error) {
+	lenBuf := make([]byte, 2+Overhead)
+	_, err := io.ReadFull(s.Conn, lenBuf)
+	if err != nil {
+		return nil, err
+	}
+	lenBuf, err = s.open(lenBuf)
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.LittleEndian.Uint16(lenBuf))
+
+	// read the actual message
+	buf := make([]byte, length+Overhead)
+	_, err = io.ReadFull(s.Conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(buf)
+}
+
+func (s *Session) Close() error {
+	return s.Conn.Close()
+}
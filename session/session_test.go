@@ -0,0 +1,268 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package session
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func newKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+type handshakeResult struct {
+	slave, master       *Session
+	slaveErr, masterErr error
+}
+
+// handshake connects a slave and a master over net.Pipe
+func handshake(t *testing.T, slaveKey, masterKey *ecdh.PrivateKey, dialKey *ecdh.PublicKey,
+	slavePsk, masterPsk []byte, allowed *ecdh.PublicKey) handshakeResult {
+
+	slaveConn, masterConn := net.Pipe()
+	t.Cleanup(func() {
+		slaveConn.Close()
+		masterConn.Close()
+	})
+
+	var res handshakeResult
+	done := make(chan struct{})
+	go func() {
+		res.slave, res.slaveErr = Dial(slaveConn, slaveKey, dialKey, slavePsk)
+		if res.slaveErr != nil {
+			slaveConn.Close()
+		}
+		close(done)
+	}()
+
+	res.master, res.masterErr = Accept(masterConn, masterKey, masterPsk, func(k *ecdh.PublicKey) bool {
+		return k.Equal(allowed)
+	})
+	if res.masterErr != nil {
+		masterConn.Close()
+	}
+	<-done
+
+	return res
+}
+
+func TestRoundTrip(t *testing.T) {
+	slaveKey, masterKey := newKey(t), newKey(t)
+	psk := []byte("master password")
+
+	res := handshake(t, slaveKey, masterKey, masterKey.PublicKey(), psk, psk, slaveKey.PublicKey())
+	if res.slaveErr != nil || res.masterErr != nil {
+		t.Fatal(res.slaveErr, res.masterErr)
+	}
+	if !res.master.RemoteKey.Equal(slaveKey.PublicKey()) {
+		t.Fatal("master has the wrong slave key")
+	}
+
+	messages := [][]byte{
+		[]byte("hello"),
+		{},
+		bytes.Repeat([]byte{0xaa}, math.MaxUint16),
+		[]byte("bye"),
+	}
+	for _, pair := range []struct {
+		name     string
+		from, to *Session
+	}{
+		{"slave to master", res.slave, res.master},
+		{"master to slave", res.master, res.slave},
+	} {
+		errs := make(chan error, 1)
+		go func() {
+			for _, v := range messages {
+				if err := pair.from.Write(v); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+
+		for i, v := range messages {
+			msg, err := pair.to.Read()
+			if err != nil {
+				t.Fatalf("%s: message %d: %v", pair.name, i, err)
+			}
+			if !bytes.Equal(msg, v) {
+				t.Fatalf("%s: message %d differs", pair.name, i)
+			}
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := res.slave.Write(make([]byte, math.MaxUint16+1)); err == nil {
+		t.Fatal("oversized frame accepted")
+	}
+}
+
+func TestNotAllowed(t *testing.T) {
+	slaveKey, masterKey := newKey(t), newKey(t)
+	psk := []byte("master password")
+
+	res := handshake(t, slaveKey, masterKey, masterKey.PublicKey(), psk, psk, newKey(t).PublicKey())
+	if !errors.Is(res.masterErr, ErrNotAllowed) {
+		t.Fatalf("expected ErrNotAllowed, got %v", res.masterErr)
+	}
+	if res.slaveErr == nil {
+		t.Fatal("slave handshake succeeded")
+	}
+}
+
+// the handshake doesn't authenticate the keys by itself: a mismatch makes the first frame fail
+func TestKeyMismatch(t *testing.T) {
+	slaveKey, masterKey := newKey(t), newKey(t)
+	psk := []byte("master password")
+
+	tests := []struct {
+		name      string
+		dialKey   *ecdh.PublicKey
+		masterPsk []byte
+	}{
+		{"wrong psk", masterKey.PublicKey(), []byte("another password")},
+		{"wrong master key", newKey(t).PublicKey(), psk},
+	}
+	for _, v := range tests {
+		res := handshake(t, slaveKey, masterKey, v.dialKey, psk, v.masterPsk, slaveKey.PublicKey())
+		if res.slaveErr != nil || res.masterErr != nil {
+			t.Fatal(res.slaveErr, res.masterErr)
+		}
+
+		go res.slave.Write([]byte("share batch"))
+		if _, err := res.master.Read(); err == nil {
+			t.Errorf("%s: frame accepted", v.name)
+		}
+	}
+}
+
+// frameConn records the frames written to it, and reads from r
+type frameConn struct {
+	net.Conn
+	frames [][]byte
+	r      io.Reader
+}
+
+func (c *frameConn) Write(b []byte) (int, error) {
+	c.frames = append(c.frames, append([]byte(nil), b...))
+	return len(b), nil
+}
+func (c *frameConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+func (c *frameConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// sessionPair returns a master session, and the frames of three messages sent by the slave
+func sessionPair(t *testing.T) (*Session, [][]byte) {
+	slaveKey, masterKey := newKey(t), newKey(t)
+	psk := []byte("master password")
+
+	res := handshake(t, slaveKey, masterKey, masterKey.PublicKey(), psk, psk, slaveKey.PublicKey())
+	if res.slaveErr != nil || res.masterErr != nil {
+		t.Fatal(res.slaveErr, res.masterErr)
+	}
+
+	conn := &frameConn{}
+	res.slave.Conn = conn
+	for _, v := range []string{"first", "second", "third"} {
+		if err := res.slave.Write([]byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.master, conn.frames
+}
+
+// readFrames feeds the frames to the master, and returns the messages read until the first error
+func readFrames(master *Session, frames ...[]byte) ([]string, error) {
+	master.Conn = &frameConn{r: bytes.NewReader(bytes.Join(frames, nil))}
+
+	var messages []string
+	for range frames {
+		msg, err := master.Read()
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, string(msg))
+	}
+	return messages, nil
+}
+
+func TestFrameCounter(t *testing.T) {
+	tests := []struct {
+		name     string
+		order    []int
+		messages int // read before the error
+	}{
+		{"in order", []int{0, 1, 2}, 3},
+		{"replayed", []int{0, 0}, 1},
+		{"replayed later", []int{0, 1, 0}, 2},
+		{"reordered", []int{1, 0}, 0},
+		{"dropped", []int{0, 2}, 1},
+	}
+
+	for _, v := range tests {
+		t.Run(v.name, func(t *testing.T) {
+			master, f := sessionPair(t)
+
+			var ordered [][]byte
+			for _, i := range v.order {
+				ordered = append(ordered, f[i])
+			}
+			messages, err := readFrames(master, ordered...)
+			if len(messages) != v.messages {
+				t.Fatalf("read %d messages (%v), expected %d", len(messages), messages, v.messages)
+			}
+			if v.messages == len(v.order) && err != nil {
+				t.Fatal(err)
+			} else if v.messages != len(v.order) && err == nil {
+				t.Fatal("frame accepted")
+			}
+		})
+	}
+}
+
+func TestTamperedFrame(t *testing.T) {
+	// offsets in the first frame: encrypted length, its tag, then the message and its tag
+	for _, offset := range []int{0, 2, 2 + Overhead, 2 + Overhead + 5} {
+		master, f := sessionPair(t)
+		f[0][offset] ^= 1
+
+		messages, err := readFrames(master, f[0])
+		if err == nil || len(messages) != 0 {
+			t.Errorf("frame tampered at offset %d accepted", offset)
+		}
+	}
+}
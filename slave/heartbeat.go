@@ -0,0 +1,133 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package slave
+
+import (
+	"go-pool/serializer"
+)
+
+type StratumPort struct {
+	Port uint16 `json:"port"`
+	Tls  bool   `json:"tls"`
+	Desc string `json:"desc"`
+
+	WebSocket bool `json:"websocket"`
+}
+
+// Heartbeat is sent by the slave to the master every 10 seconds
+type Heartbeat struct {
+	Name       string `json:"name"`
+	Region     string `json:"region"`
+	Version    string `json:"version"`
+	PublicHost string `json:"public_host"`
+
+	Connections uint32 `json:"connections"`
+
+	DaemonHeight uint64 `json:"daemon_height"`
+	DaemonSynced bool   `json:"daemon_synced"`
+
+	PowLatency uint64 `json:"pow_latency_us"` // average calc_pow latency since the last heartbeat, in microseconds
+
+	// shares since the slave started
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+
+	// since the slave started
+	RefusedConns  uint64 `json:"refused_conns"` // connections refused because of the limits
+	LoginTimeouts uint64 `json:"login_timeouts"`
+	RateLimited   uint64 `json:"rate_limited"`   // requests rejected because of the rate limit
+	SlowConsumers uint64 `json:"slow_consumers"` // miners disconnected because they didn't read their messages
+
+	BroadcastLatency uint64 `json:"broadcast_latency_us"` // time to send the last new jobs to all the miners, in microseconds
+
+	Ports []StratumPort `json:"ports"`
+
+	TlsFingerprint string `json:"tls_fingerprint"` // SHA-256 of the TLS certificate, hex
+
+	Uptime uint64 `json:"uptime"` // in seconds
+}
+
+func (h *Heartbeat) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddString(h.Name)
+	s.AddString(h.Region)
+	s.AddString(h.Version)
+	s.AddString(h.PublicHost)
+	s.AddUvarint(uint64(h.Connections))
+	s.AddUvarint(h.DaemonHeight)
+	s.AddBool(h.DaemonSynced)
+	s.AddUvarint(h.PowLatency)
+	s.AddUvarint(h.Accepted)
+	s.AddUvarint(h.Rejected)
+	s.AddUvarint(h.RefusedConns)
+	s.AddUvarint(h.LoginTimeouts)
+	s.AddUvarint(h.RateLimited)
+
+	s.AddUvarint(uint64(len(h.Ports)))
+	for _, v := range h.Ports {
+		s.AddUint16(v.Port)
+		s.AddBool(v.Tls)
+		s.AddString(v.Desc)
+		s.AddBool(v.WebSocket)
+	}
+	s.AddString(h.TlsFingerprint)
+	s.AddUvarint(h.SlowConsumers)
+	s.AddUvarint(h.BroadcastLatency)
+
+	s.AddUvarint(h.Uptime)
+
+	return s.Data
+}
+func (h *Heartbeat) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	h.Name = d.ReadString()
+	h.Region = d.ReadString()
+	h.Version = d.ReadString()
+	h.PublicHost = d.ReadString()
+	h.Connections = uint32(d.ReadUvarint())
+	h.DaemonHeight = d.ReadUvarint()
+	h.DaemonSynced = d.ReadBool()
+	h.PowLatency = d.ReadUvarint()
+	h.Accepted = d.ReadUvarint()
+	h.Rejected = d.ReadUvarint()
+	h.RefusedConns = d.ReadUvarint()
+	h.LoginTimeouts = d.ReadUvarint()
+	h.RateLimited = d.ReadUvarint()
+
+	numPorts := d.ReadUvarint()
+	h.Ports = make([]StratumPort, 0)
+	for i := uint64(0); i < numPorts && d.Error == nil; i++ {
+		h.Ports = append(h.Ports, StratumPort{
+			Port:      d.ReadUint16(),
+			Tls:       d.ReadBool(),
+			Desc:      d.ReadString(),
+			WebSocket: d.ReadBool(),
+		})
+	}
+	h.TlsFingerprint = d.ReadString()
+	h.SlowConsumers = d.ReadUvarint()
+	h.BroadcastLatency = d.ReadUvarint()
+
+	h.Uptime = d.ReadUvarint()
+
+	return d.Error
+}
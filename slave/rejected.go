@@ -0,0 +1,150 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package slave
+
+import (
+	"go-pool/logger"
+	"go-pool/serializer"
+	"sync"
+)
+
+// Reasons for rejecting a share
+const (
+	REJECT_MALFORMED = iota
+	REJECT_STALE
+	REJECT_WRONG_JOB
+	REJECT_NICEHASH
+	REJECT_DUPLICATE
+	REJECT_WRONG_HASH
+	REJECT_LOW_DIFF
+	REJECT_SERVER_BUSY // not the miner's fault
+	REJECT_INTERNAL    // not the miner's fault
+)
+
+var RejectReasons = map[uint8]string{
+	REJECT_MALFORMED:   "malformed",
+	REJECT_STALE:       "stale",
+	REJECT_WRONG_JOB:   "wrong_job_id",
+	REJECT_NICEHASH:    "wrong_nicehash_nonce",
+	REJECT_DUPLICATE:   "duplicate",
+	REJECT_WRONG_HASH:  "wrong_hash",
+	REJECT_LOW_DIFF:    "low_difficulty",
+	REJECT_SERVER_BUSY: "server_busy",
+	REJECT_INTERNAL:    "internal_error",
+}
+
+type RejectKey struct {
+	Wallet string
+	Worker string
+	Reason uint8
+}
+
+type RejectedShares struct {
+	Key   RejectKey
+	Count uint32
+}
+
+var rejectCache = struct {
+	Counts map[RejectKey]uint32
+	sync.Mutex
+}{
+	Counts: make(map[RejectKey]uint32),
+}
+
+// max number of entries in a rejected shares packet, so that it fits in a single frame
+const MAX_REJECTED_ENTRIES = 256
+
+func SendRejected(wallet, worker string, reason uint8) {
+	rejectCache.Lock()
+	defer rejectCache.Unlock()
+
+	rejectCache.Counts[RejectKey{
+		Wallet: wallet,
+		Worker: worker,
+		Reason: reason,
+	}]++
+}
+
+// sendRejectedShares sends the rejected shares counted since the last call.
+// They are kept for the next call while the master is not connected.
+// connMut must be locked
+func sendRejectedShares() {
+	if conn == nil {
+		return
+	}
+
+	rejectCache.Lock()
+	counts := rejectCache.Counts
+	rejectCache.Counts = make(map[RejectKey]uint32)
+	rejectCache.Unlock()
+
+	list := make([]RejectedShares, 0, len(counts))
+	for k, v := range counts {
+		list = append(list, RejectedShares{
+			Key:   k,
+			Count: v,
+		})
+	}
+
+	for len(list) > 0 {
+		n := min(len(list), MAX_REJECTED_ENTRIES)
+
+		logger.Debug("sending", n, "rejected shares entries")
+		sendToConn(SerializeRejected(list[:n]))
+
+		list = list[n:]
+	}
+}
+
+func SerializeRejected(list []RejectedShares) []byte {
+	s := serializer.Serializer{
+		Data: []byte{5},
+	}
+
+	s.AddUvarint(uint64(len(list)))
+	for _, v := range list {
+		s.AddString(v.Key.Wallet)
+		s.AddString(v.Key.Worker)
+		s.AddUint8(v.Key.Reason)
+		s.AddUvarint(uint64(v.Count))
+	}
+
+	return s.Data
+}
+
+// DeserializeRejected reads a rejected shares packet, without the packet type
+func DeserializeRejected(data []byte) ([]RejectedShares, error) {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	n := d.ReadUvarint()
+	list := make([]RejectedShares, 0)
+	for i := uint64(0); i < n && d.Error == nil; i++ {
+		list = append(list, RejectedShares{
+			Key: RejectKey{
+				Wallet: d.ReadString(),
+				Worker: d.ReadString(),
+				Reason: d.ReadUint8(),
+			},
+			Count: uint32(d.ReadUvarint()),
+		})
+	}
+
+	return list, d.Error
+}
@@ -18,78 +18,76 @@
 package slave
 
 import (
-	"crypto/rand"
-	"encoding/binary"
 	"encoding/hex"
 	"go-pool/config"
 	"go-pool/logger"
 	"go-pool/serializer"
-	"io"
+	"go-pool/session"
 	"net"
 	"sync"
 	"time"
-
-	"golang.org/x/crypto/chacha20poly1305"
 )
 
-var conn net.Conn
+var conn *session.Session
 var connMut sync.RWMutex
 
-const Overhead = 40
-
 func StartSlaveClient() {
-out:
+	key, err := session.LoadKey("slave.key")
+	if err != nil {
+		logger.Fatal("could not load slave key:", err)
+	}
+	logger.Info("Slave public key is", session.PublicKeyString(key.PublicKey()))
+
+	masterKey, err := session.ParsePublicKey(config.Cfg.SlaveConfig.MasterPublicKey)
+	if err != nil {
+		logger.Fatal("invalid master public key:", err)
+	}
+
+	err = openSpool()
+	if err != nil {
+		logger.Fatal("could not open share spool:", err)
+	}
+	go flushCache()
+
 	for {
 		logger.Info("Connecting to master server:", config.Cfg.SlaveConfig.MasterAddress)
 
-		var err error
-		conn, err = net.Dial("tcp", config.Cfg.SlaveConfig.MasterAddress)
-
+		c, err := net.Dial("tcp", config.Cfg.SlaveConfig.MasterAddress)
 		if err != nil {
 			logger.Error(err)
 			time.Sleep(time.Second)
-			continue out
+			continue
 		}
 
-		for {
-			lenBuf := make([]byte, 2+Overhead)
-			_, err := io.ReadFull(conn, lenBuf)
-			if err != nil {
-				logger.Warn(err)
-				conn.Close()
-				time.Sleep(time.Second)
-				continue out
-			}
-			lenBuf, err = Decrypt(lenBuf)
-			if err != nil {
-				logger.Warn(err)
-				conn.Close()
-				time.Sleep(time.Second)
-				continue out
-			}
-			len := int(lenBuf[0]) | (int(lenBuf[1]) << 8)
+		sess, err := session.Dial(c, key, masterKey, config.MasterPass[:])
+		if err != nil {
+			logger.Error("master handshake failed:", err)
+			c.Close()
+			time.Sleep(time.Second)
+			continue
+		}
 
-			// read the actual message
+		connMut.Lock()
+		conn = sess
+		replaySpool()
+		connMut.Unlock()
 
-			buf := make([]byte, len+Overhead)
-			_, err = io.ReadFull(conn, buf)
-			if err != nil {
-				logger.Warn(err)
-				conn.Close()
-				time.Sleep(time.Second)
-				continue out
-			}
-			buf, err = Decrypt(buf)
+		for {
+			buf, err := sess.Read()
 			if err != nil {
 				logger.Warn(err)
-				conn.Close()
-				time.Sleep(time.Second)
-				continue out
+				break
 			}
 			logger.Net("Received message:", hex.EncodeToString(buf))
 			OnMessage(buf)
 		}
 
+		connMut.Lock()
+		conn = nil
+		connMut.Unlock()
+
+		sess.Close()
+		time.Sleep(time.Second)
 	}
 }
 func OnMessage(b []byte) {
@@ -100,34 +98,44 @@ func OnMessage(b []byte) {
 	packet := d.ReadUint8()
 
 	switch packet {
+	case 0: // Share Batch Ack packet
+		id := d.ReadUvarint()
 
-	}
-}
-
-func SendShare(wallet string, diff uint64) {
-	connMut.Lock()
-	defer connMut.Unlock()
-
-	cacheShare(wallet, diff)
-
-	/*if conn == nil {
-		cacheShare(wallet, diff)
+		if d.Error != nil {
+			logger.Error(d.Error)
+			return
+		}
 
-		return
-	}
+		ackBatch(id)
+	case 1: // Settings packet
+		var st config.SlaveSettings
+		err := st.Deserialize(d.Data)
+		if err == nil {
+			err = st.Validate()
+		}
+		if err != nil {
+			logger.Error("invalid settings from master:", err)
+			return
+		}
 
-	s := serializer.Serializer{
-		Data: []byte{0},
+		if st != config.GetSlaveSettings() {
+			logger.Info("Applying settings from master: min diff", st.MinDiff, "share target time", st.ShareTargetTime,
+				"trust score", st.TrustScore, "template timeout", st.TemplateTimeout, "slave fee", st.SlaveFee)
+			config.SetSlaveSettings(st)
+		}
+	default:
+		logger.Error("unknown packet type", packet)
 	}
+}
 
-	s.AddUvarint(1)
-	s.AddString(wallet)
-	s.AddUvarint(diff)
-
-	sendToConn(s.Data)*/
+func SendShare(wallet, worker string, diff uint64) {
+	cacheShare(wallet, worker, diff)
 }
 
 func SendBlockFound(height, reward uint64, hash []byte) {
+	connMut.RLock()
+	defer connMut.RUnlock()
+
 	s := serializer.Serializer{
 		Data: []byte{1},
 	}
@@ -138,15 +146,16 @@ func SendBlockFound(height, reward uint64, hash []byte) {
 
 	sendToConn(s.Data)
 }
-func SendStats(nrMiners int) {
-	s := serializer.Serializer{
-		Data: []byte{2},
-	}
-	s.AddUvarint(uint64(nrMiners))
+func SendHeartbeat(h *Heartbeat) {
+	connMut.RLock()
+	defer connMut.RUnlock()
 
-	sendToConn(s.Data)
+	sendToConn(append([]byte{2}, h.Serialize()...))
 }
 func SendShareFound(height uint64) {
+	connMut.RLock()
+	defer connMut.RUnlock()
+
 	s := serializer.Serializer{
 		Data: []byte{3},
 	}
@@ -155,48 +164,15 @@ func SendShareFound(height uint64) {
 
 	sendToConn(s.Data)
 }
+
+// connMut must be at least RLocked
 func sendToConn(data []byte) {
 	if conn == nil {
 		logger.Error("SendToConn: Connection is nil")
 		return
 	}
-	var dataLenBin = make([]byte, 0, 2)
-	dataLenBin = binary.LittleEndian.AppendUint16(dataLenBin, uint16(len(data)))
-	conn.Write(Encrypt(dataLenBin))
-	conn.Write(Encrypt(data))
-}
-
-func Encrypt(msg []byte) []byte {
-	aead, err := chacha20poly1305.NewX(config.MasterPass[:])
-	if err != nil {
-		panic(err)
-	}
-
-	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(msg)+aead.Overhead())
-	rand.Read(nonce)
-
-	// Encrypt the message and append the ciphertext to the nonce.
-	return aead.Seal(nonce, nonce, msg, nil)
-}
-
-func Decrypt(msg []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.NewX(config.MasterPass[:])
+	err := conn.Write(data)
 	if err != nil {
-		panic(err)
+		logger.Warn("SendToConn:", err)
 	}
-
-	if len(msg) < aead.NonceSize() {
-		panic("ciphertext too short")
-	}
-
-	// Split nonce and ciphertext.
-	nonce, ciphertext := msg[:aead.NonceSize()], msg[aead.NonceSize():]
-
-	// Decrypt the message and check it wasn't tampered with.
-	decrypted, err := aead.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return []byte{}, err
-	}
-
-	return decrypted, nil
 }
@@ -18,8 +18,9 @@
 package slave
 
 import (
+	"go-pool/database"
 	"go-pool/logger"
-	"go-pool/serializer"
+	"go-pool/util"
 	"sync"
 	"time"
 )
@@ -29,57 +30,176 @@ type ShareCache struct {
 	TotalDiff uint64
 }
 
+type CacheKey struct {
+	Wallet string
+	Worker string
+}
+
 type Cache struct {
-	Shares map[string]ShareCache
+	Shares map[CacheKey]ShareCache
 
 	sync.RWMutex
 }
 
 var slaveCache = Cache{
-	Shares: map[string]ShareCache{},
+	Shares: map[CacheKey]ShareCache{},
 }
 
-func cacheShare(wallet string, diff uint64) {
+func cacheShare(wallet, worker string, diff uint64) {
 	slaveCache.Lock()
 	defer slaveCache.Unlock()
 
-	x := slaveCache.Shares[wallet]
+	k := CacheKey{
+		Wallet: wallet,
+		Worker: worker,
+	}
+	x := slaveCache.Shares[k]
 
 	x.NumShares++
 	x.TotalDiff += diff
 
-	slaveCache.Shares[wallet] = x
+	slaveCache.Shares[k] = x
+}
+
+// recacheShares adds the shares of a batch that wasn't sent back to the cache
+func recacheShares(v database.BatchShare) {
+	slaveCache.Lock()
+	defer slaveCache.Unlock()
+
+	k := CacheKey{
+		Wallet: v.Wallet,
+		Worker: v.Worker,
+	}
+	x := slaveCache.Shares[k]
+
+	x.NumShares += v.Count
+	x.TotalDiff += v.Diff
+
+	slaveCache.Shares[k] = x
 }
 
-func init() {
-	go func() {
-		for {
-			time.Sleep(10 * time.Second)
-
-			connMut.Lock()
-			if conn != nil {
-				slaveCache.Lock()
-				logger.Debug("sending cached shares")
-				for i, v := range slaveCache.Shares {
-					logger.Debug("sending cache share with address:", i, "count", v.NumShares, "total diff", v.TotalDiff)
-					sendCachedShare(v.NumShares, i, v.TotalDiff)
-				}
-				slaveCache.Shares = make(map[string]ShareCache, 100)
-				slaveCache.Unlock()
-			}
-			connMut.Unlock()
+// max number of wallets in a batch, so that it fits in a single frame
+const MAX_BATCH_SHARES = 256
+
+// flushCache moves the cached shares to the spool every 10 seconds, and sends them to the master
+func flushCache() {
+	for {
+		time.Sleep(10 * time.Second)
+
+		flush()
+	}
+}
+
+var flushMut sync.Mutex
+var stopped bool // set by Shutdown, flushMut must be locked
+
+// flush moves the cached shares to the spool, and sends them to the master
+func flush() {
+	flushMut.Lock()
+	defer flushMut.Unlock()
+
+	if stopped {
+		return
+	}
+
+	connMut.Lock()
+	sendRejectedShares()
+	connMut.Unlock()
+
+	slaveCache.Lock()
+	cached := slaveCache.Shares
+	slaveCache.Shares = make(map[CacheKey]ShareCache, 100)
+	slaveCache.Unlock()
+
+	if len(cached) == 0 {
+		return
+	}
+
+	batch := database.ShareBatch{
+		Time: util.Time(),
+	}
+
+	connMut.Lock()
+	for i, v := range cached {
+		logger.Debug("spooling cached share with address:", i.Wallet, "worker", i.Worker, "count", v.NumShares, "total diff", v.TotalDiff)
+		batch.Shares = append(batch.Shares, database.BatchShare{
+			Wallet: i.Wallet,
+			Worker: i.Worker,
+			Count:  v.NumShares,
+			Diff:   v.TotalDiff,
+		})
+
+		if len(batch.Shares) == MAX_BATCH_SHARES {
+			sendBatch(&batch)
+			batch.Shares = nil
 		}
-	}()
+	}
+	if len(batch.Shares) != 0 {
+		sendBatch(&batch)
+	}
+	connMut.Unlock()
 }
 
-func sendCachedShare(count uint32, wallet string, diff uint64) {
-	s := serializer.Serializer{
-		Data: []byte{0},
+// Shutdown moves the cached shares to the spool and sends them to the master, then waits for the
+// master to acknowledge them until the timeout. The batches that are not acknowledged stay in the
+// spool, and are sent on the next start.
+func Shutdown(timeout time.Duration) {
+	flushMut.Lock()
+	opened := spool != nil
+	flushMut.Unlock()
+	if !opened {
+		logger.Warn("share spool is not open, the cached shares are lost")
+		return
+	}
+
+	flush()
+
+	deadline := time.Now().Add(timeout)
+	pending := pendingBatches()
+	for len(pending) != 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		pending = pendingBatches()
 	}
+	if len(pending) != 0 {
+		logger.Warn(len(pending), "share batches were not acknowledged by the master, they will be sent on the next start")
+	}
+
+	flushMut.Lock()
+	defer flushMut.Unlock()
 
-	s.AddUvarint(uint64(count))
-	s.AddString(wallet)
-	s.AddUvarint(diff)
+	stopped = true
+	err := spool.Close()
+	if err != nil {
+		logger.Error("could not close share spool:", err)
+	}
+}
 
-	sendToConn(s.Data)
+// sendBatch writes the batch to the spool, then sends it if the master is connected.
+// If it's not acknowledged, it will be sent again on reconnect. If it can't be spooled, its shares
+// are cached again, to be sent with the next batch.
+// connMut must be locked
+func sendBatch(batch *database.ShareBatch) {
+	err := spoolBatch(batch)
+	if err != nil {
+		logger.Error("could not spool share batch:", err)
+		for _, v := range batch.Shares {
+			recacheShares(v)
+		}
+		return
+	}
+	if conn == nil {
+		return
+	}
+	sendToConn(append([]byte{4}, batch.Serialize()...))
+}
+
+// replaySpool sends all the unacknowledged batches. connMut must be locked
+func replaySpool() {
+	batches := pendingBatches()
+	if len(batches) != 0 {
+		logger.Info("Sending", len(batches), "unacknowledged share batches")
+	}
+	for _, v := range batches {
+		sendToConn(append([]byte{4}, v...))
+	}
 }
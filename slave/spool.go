@@ -0,0 +1,129 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package slave
+
+import (
+	"encoding/binary"
+	"errors"
+	"go-pool/database"
+	"go-pool/logger"
+	"go-pool/util"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+The spool keeps the share batches on disk until the master acknowledges them.
+
+batches: batch id -> serialized database.ShareBatch
+meta: "spool_id" -> random id of the spool, so the master can tell apart spools with the same batch ids
+*/
+
+var (
+	SPOOL_BATCHES = []byte("b")
+	SPOOL_META    = []byte("m")
+)
+
+var spool *bolt.DB
+var spoolId uint64
+
+// openSpool opens the spool. If another slave is using it (while it's shutting down, after a
+// restart), it waits for the other slave to exit.
+func openSpool() error {
+	db, err := bolt.Open("spool.db", 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		logger.Info("spool.db is in use by another slave, waiting for it to exit")
+		db, err = bolt.Open("spool.db", 0o600, bolt.DefaultOptions)
+	}
+	if err != nil {
+		return err
+	}
+
+	flushMut.Lock()
+	spool = db
+	flushMut.Unlock()
+
+	return spool.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(SPOOL_BATCHES)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(SPOOL_META)
+		if err != nil {
+			return err
+		}
+
+		id := meta.Get([]byte("spool_id"))
+		if id == nil {
+			spoolId = util.RandomUint64()
+			return meta.Put([]byte("spool_id"), util.Itob(spoolId))
+		}
+		spoolId = binary.BigEndian.Uint64(id)
+		return nil
+	})
+}
+
+// spoolBatch writes the batch to the spool, and assigns its id once it's written. The id of a
+// batch that couldn't be spooled would be assigned again to the next one.
+func spoolBatch(batch *database.ShareBatch) error {
+	spooled := *batch
+	err := spool.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(SPOOL_BATCHES)
+
+		id, err := buck.NextSequence()
+		if err != nil {
+			return err
+		}
+		spooled.Spool = spoolId
+		spooled.ID = id
+
+		return buck.Put(util.Itob(id), spooled.Serialize())
+	})
+	if err != nil {
+		return err
+	}
+
+	batch.Spool = spooled.Spool
+	batch.ID = spooled.ID
+	return nil
+}
+
+// ackBatch removes a batch the master has stored from the spool
+func ackBatch(id uint64) {
+	err := spool.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(SPOOL_BATCHES).Delete(util.Itob(id))
+	})
+	if err != nil {
+		logger.Error("could not remove acknowledged batch", id, "from spool:", err)
+	}
+}
+
+// pendingBatches returns the serialized batches not acknowledged yet, oldest first
+func pendingBatches() (batches [][]byte) {
+	err := spool.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(SPOOL_BATCHES).ForEach(func(k, v []byte) error {
+			batches = append(batches, append([]byte(nil), v...))
+			return nil
+		})
+	})
+	if err != nil {
+		logger.Error("could not read spool:", err)
+	}
+	return
+}
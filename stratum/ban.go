@@ -0,0 +1,417 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"encoding/json"
+	"errors"
+	"go-pool/config"
+	"go-pool/logger"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DEFAULT_BAN_TIME = 3600 // seconds
+const DEFAULT_INVALID_PERCENT = 50
+const DEFAULT_CHECK_THRESHOLD = 30
+const DEFAULT_MALFORMED_LIMIT = 10
+const DEFAULT_LOGIN_LIMIT = 30
+
+// the counters of the peers are reset after this many seconds
+const BAN_WINDOW = 10 * 60
+
+// logins are counted over this many seconds
+const LOGIN_WINDOW = 60
+
+// Ban is an IP or payout address ban
+type Ban struct {
+	Target  string `json:"target"`
+	Reason  string `json:"reason"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"` // unix seconds, 0 means never
+}
+
+type peerCounter struct {
+	windowStart int64
+	valid       uint32
+	invalid     uint32
+	malformed   uint32
+
+	loginStart int64
+	logins     uint32
+}
+
+// BanManager keeps the banned IPs and addresses, and bans the peers that exceed the thresholds.
+// A nil BanManager bans nobody.
+type BanManager struct {
+	bans     map[string]Ban
+	counters map[string]*peerCounter // by IP or address
+
+	// the bans added, or lifted (nil), since the last save. They are merged with the file when
+	// it is saved, so that the changes made by another process (like `slave ban`) are kept.
+	pending map[string]*Ban
+
+	cfg     config.BanConfig
+	path    string
+	modTime time.Time
+
+	sync.Mutex
+	saveMut sync.Mutex // the file is read and written without holding the lock
+}
+
+// NewBanManager loads the bans saved at path. The bans are reloaded when the file is changed
+// by another process.
+func NewBanManager(path string, cfg config.BanConfig) (*BanManager, error) {
+	if cfg.BanTime <= 0 {
+		cfg.BanTime = DEFAULT_BAN_TIME
+	}
+	if cfg.InvalidPercent <= 0 {
+		cfg.InvalidPercent = DEFAULT_INVALID_PERCENT
+	}
+	if cfg.CheckThreshold == 0 {
+		cfg.CheckThreshold = DEFAULT_CHECK_THRESHOLD
+	}
+	if cfg.MalformedLimit == 0 {
+		cfg.MalformedLimit = DEFAULT_MALFORMED_LIMIT
+	}
+	if cfg.LoginLimit == 0 {
+		cfg.LoginLimit = DEFAULT_LOGIN_LIMIT
+	}
+
+	b := &BanManager{
+		counters: make(map[string]*peerCounter),
+		pending:  make(map[string]*Ban),
+		cfg:      cfg,
+		path:     path,
+	}
+
+	var err error
+	b.bans, b.modTime, err = readBans(path)
+	return b, err
+}
+
+// readBans reads the bans file, without the expired bans
+func readBans(path string) (map[string]Ban, time.Time, error) {
+	bans := make(map[string]Ban)
+
+	st, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bans, time.Time{}, nil
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var list []Ban
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	now := time.Now().Unix()
+	for _, v := range list {
+		if v.Expires == 0 || v.Expires > now {
+			bans[v.Target] = v
+		}
+	}
+	return bans, st.ModTime(), nil
+}
+
+// applyBans applies the pending changes to bans
+func applyBans(bans map[string]Ban, pending map[string]*Ban) {
+	for target, v := range pending {
+		if v == nil {
+			delete(bans, target)
+		} else {
+			bans[target] = *v
+		}
+	}
+}
+
+// Save merges the changes made since the last save with the bans file, and writes it. The bans
+// are reloaded from the file too, if another process changed it.
+func (b *BanManager) Save() error {
+	if b == nil {
+		return nil
+	}
+
+	b.saveMut.Lock()
+	defer b.saveMut.Unlock()
+
+	b.Lock()
+	pending := b.pending
+	b.pending = make(map[string]*Ban)
+	b.Unlock()
+
+	bans, modTime, err := readBans(b.path)
+	if err == nil && len(pending) != 0 {
+		applyBans(bans, pending)
+
+		var data []byte
+		data, err = json.MarshalIndent(sortBans(bans), "", "\t")
+		if err == nil {
+			modTime, err = replaceFile(b.path, data)
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if err != nil {
+		// kept for the next save, unless they were changed again meanwhile
+		for target, v := range pending {
+			if _, ok := b.pending[target]; !ok {
+				b.pending[target] = v
+			}
+		}
+		return err
+	}
+
+	// the changes made while the file was written
+	applyBans(bans, b.pending)
+	b.bans = bans
+	b.modTime = modTime
+
+	return nil
+}
+
+// sortBans returns the bans, oldest first
+func sortBans(bans map[string]Ban) []Ban {
+	list := make([]Ban, 0, len(bans))
+	for _, v := range bans {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created < list[j].Created
+	})
+	return list
+}
+
+// Run removes the expired bans and the old counters, and saves the bans or reloads them if the
+// file was changed. It never returns.
+func (b *BanManager) Run() {
+	for {
+		time.Sleep(10 * time.Second)
+
+		b.Lock()
+		now := time.Now().Unix()
+		for i, v := range b.bans {
+			if v.Expires != 0 && v.Expires <= now {
+				logger.Info("Ban of", v.Target, "expired")
+				delete(b.bans, i)
+			}
+		}
+
+		for i, v := range b.counters {
+			if v.windowStart+BAN_WINDOW <= now && v.loginStart+LOGIN_WINDOW <= now {
+				delete(b.counters, i)
+			}
+		}
+
+		changed := len(b.pending) != 0
+		modTime := b.modTime
+		b.Unlock()
+
+		st, err := os.Stat(b.path)
+		if err == nil && !st.ModTime().Equal(modTime) {
+			logger.Info("Bans file changed, reloading")
+			changed = true
+		}
+		if changed {
+			err = b.Save()
+			if err != nil {
+				logger.Error("could not save bans:", err)
+			}
+		}
+	}
+}
+
+// IsBanned returns the ban of the IP or address, if any
+func (b *BanManager) IsBanned(target string) (Ban, bool) {
+	if b == nil {
+		return Ban{}, false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	ban, ok := b.bans[target]
+	if ok && ban.Expires != 0 && ban.Expires <= time.Now().Unix() {
+		return Ban{}, false
+	}
+	return ban, ok
+}
+
+// Ban bans an IP or address. If duration is zero, the ban never expires.
+func (b *BanManager) Ban(target, reason string, duration time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.ban(target, reason, duration)
+}
+
+// b must be locked
+func (b *BanManager) ban(target, reason string, duration time.Duration) {
+	now := time.Now()
+
+	ban := Ban{
+		Target:  target,
+		Reason:  reason,
+		Created: now.Unix(),
+	}
+	if duration != 0 {
+		ban.Expires = now.Add(duration).Unix()
+	}
+
+	logger.Warn("Banning", target, "for", duration, "reason:", reason)
+
+	b.bans[target] = ban
+	b.pending[target] = &ban
+	delete(b.counters, target)
+}
+
+// Lift removes the ban of an IP or address. Returns false if it was not banned.
+func (b *BanManager) Lift(target string) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, ok := b.bans[target]; !ok {
+		return false
+	}
+
+	logger.Info("Lifting ban of", target)
+
+	delete(b.bans, target)
+	b.pending[target] = nil
+	return true
+}
+
+// List returns all the bans, oldest first
+func (b *BanManager) List() []Ban {
+	b.Lock()
+	defer b.Unlock()
+
+	return sortBans(b.bans)
+}
+
+// b must be locked
+func (b *BanManager) counter(target string) *peerCounter {
+	c := b.counters[target]
+	if c == nil {
+		c = &peerCounter{}
+		b.counters[target] = c
+	}
+
+	now := time.Now().Unix()
+	if c.windowStart+BAN_WINDOW <= now {
+		c.windowStart = now
+		c.valid = 0
+		c.invalid = 0
+		c.malformed = 0
+	}
+	return c
+}
+
+// b must be locked
+func (b *BanManager) checkShares(target string, valid bool) bool {
+	c := b.counter(target)
+	if valid {
+		c.valid++
+	} else {
+		c.invalid++
+	}
+
+	total := c.valid + c.invalid
+	if total >= b.cfg.CheckThreshold && float64(c.invalid)*100/float64(total) >= b.cfg.InvalidPercent {
+		b.ban(target, "too many invalid shares", time.Duration(b.cfg.BanTime)*time.Second)
+		return true
+	}
+	return false
+}
+
+// OnShare counts a share of the miner. Only the invalid shares the miner is responsible for
+// should be counted. Returns true if the miner was banned.
+func (b *BanManager) OnShare(ip, addr string, valid bool) bool {
+	if b == nil || !b.cfg.Enabled {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	banned := b.checkShares(ip, valid)
+
+	// anyone can submit invalid shares for any address, so this is optional
+	if b.cfg.BanAddresses && addr != "" {
+		banned = b.checkShares(addr, valid) || banned
+	}
+
+	return banned
+}
+
+// OnMalformed counts a malformed request from the IP. Returns true if the IP was banned.
+func (b *BanManager) OnMalformed(ip string) bool {
+	if b == nil || !b.cfg.Enabled {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	c := b.counter(ip)
+	c.malformed++
+	if c.malformed > b.cfg.MalformedLimit {
+		b.ban(ip, "too many malformed requests", time.Duration(b.cfg.BanTime)*time.Second)
+		return true
+	}
+	return false
+}
+
+// OnConnect counts a new connection from the IP. Returns true if the IP was banned for flooding.
+// maxConns is the number of connections the IP may keep open: they are allowed on top of the
+// login limit, so that a farm behind one IP can reconnect all its rigs at once when a slave
+// restarts.
+func (b *BanManager) OnConnect(ip string, maxConns int) bool {
+	if b == nil || !b.cfg.Enabled {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	c := b.counter(ip)
+
+	now := time.Now().Unix()
+	if c.loginStart+LOGIN_WINDOW <= now {
+		c.loginStart = now
+		c.logins = 0
+	}
+	c.logins++
+
+	if c.logins > b.cfg.LoginLimit+uint32(maxConns) {
+		b.ban(ip, "login flood", time.Duration(b.cfg.BanTime)*time.Second)
+		return true
+	}
+	return false
+}
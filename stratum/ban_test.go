@@ -0,0 +1,150 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"go-pool/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func bannedTargets(b *BanManager) map[string]bool {
+	targets := make(map[string]bool)
+	for _, v := range b.List() {
+		targets[v.Target] = true
+	}
+	return targets
+}
+
+// a running slave and the ban command change the same file
+func TestBanSaveMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+
+	running, err := NewBanManager(path, config.BanConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	running.Ban("1.1.1.1", "test", 0)
+	running.Ban("2.2.2.2", "test", 0)
+	err = running.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not saved yet
+	running.Ban("3.3.3.3", "test", time.Hour)
+
+	cmd, err := NewBanManager(path, config.BanConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Ban("4.4.4.4", "test", 0)
+	cmd.Lift("1.1.1.1")
+	err = cmd.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = running.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{"2.2.2.2": true, "3.3.3.3": true, "4.4.4.4": true}
+	check := func(name string, got map[string]bool) {
+		if len(got) != len(expected) {
+			t.Fatalf("%s: banned %v, expected %v", name, got, expected)
+		}
+		for v := range expected {
+			if !got[v] {
+				t.Fatalf("%s: banned %v, expected %v", name, got, expected)
+			}
+		}
+	}
+	check("running", bannedTargets(running))
+
+	saved, err := NewBanManager(path, config.BanConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("file", bannedTargets(saved))
+}
+
+func TestBanSaveError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bans.json")
+
+	b, err := NewBanManager(path, config.BanConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Ban("1.1.1.1", "test", 0)
+
+	os.WriteFile(path, []byte("not json"), 0o600)
+	if err := b.Save(); err == nil {
+		t.Fatal("corrupted file overwritten")
+	}
+
+	// the ban is saved once the file is fixed
+	os.Remove(path)
+	err = b.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := NewBanManager(path, config.BanConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved.IsBanned("1.1.1.1"); !ok {
+		t.Fatal("ban not saved")
+	}
+}
+
+// a farm behind one IP reconnects all its rigs when a slave restarts
+func TestBanLoginFlood(t *testing.T) {
+	b, err := NewBanManager(filepath.Join(t.TempDir(), "bans.json"), config.BanConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := NewLimiter(config.LimitsConfig{})
+
+	for i := 0; i < limits.MaxConnsPerIP(); i++ {
+		if b.OnConnect("1.2.3.4", limits.MaxConnsPerIP()) {
+			t.Fatalf("farm banned after %d connections", i+1)
+		}
+	}
+
+	// the usual reconnections of the rigs
+	for i := 0; i < DEFAULT_LOGIN_LIMIT; i++ {
+		if b.OnConnect("1.2.3.4", limits.MaxConnsPerIP()) {
+			t.Fatalf("farm banned after %d more connections", i+1)
+		}
+	}
+
+	if !b.OnConnect("1.2.3.4", limits.MaxConnsPerIP()) {
+		t.Fatal("login flood not banned")
+	}
+	if _, ok := b.IsBanned("1.2.3.4"); !ok {
+		t.Fatal("login flood not banned")
+	}
+	if _, ok := b.IsBanned("5.6.7.8"); ok {
+		t.Fatal("another IP banned")
+	}
+}
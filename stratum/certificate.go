@@ -28,7 +28,8 @@ import (
 	"time"
 )
 
-func GenCertificate() ([]byte, []byte, error) {
+// GenCertificate generates a self-signed certificate, and saves it to certFile and keyFile
+func GenCertificate(certFile, keyFile string) ([]byte, []byte, error) {
 	pubkey, key, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		return []byte{}, []byte{}, err
@@ -70,9 +71,9 @@ func GenCertificate() ([]byte, []byte, error) {
 			Bytes: derBytes,
 		},
 	)
-	err = os.WriteFile("key.pem", keyPem, 0o600)
+	err = os.WriteFile(keyFile, keyPem, 0o600)
 	if err != nil {
 		return []byte{}, []byte{}, err
 	}
-	return certPem, keyPem, os.WriteFile("cert.pem", certPem, 0o600)
+	return certPem, keyPem, os.WriteFile(certFile, certPem, 0o600)
 }
@@ -0,0 +1,188 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"go-pool/config"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_MAX_CONNS = 10000
+const DEFAULT_MAX_CONNS_PER_IP = 256 // farms are often behind a single IP
+const DEFAULT_MAX_PENDING_LOGINS = 512
+const DEFAULT_LOGIN_TIMEOUT = 30 // seconds
+const DEFAULT_REQUEST_RATE = 10  // requests per second
+const DEFAULT_REQUEST_BURST = 50
+
+// Limiter enforces the connection limits of a Server
+type Limiter struct {
+	cfg config.LimitsConfig
+
+	conns   int
+	perIP   map[string]int
+	pending int
+
+	mut sync.Mutex
+
+	// rejections since the start
+	RefusedGlobal  atomic.Uint64
+	RefusedPerIP   atomic.Uint64
+	RefusedPending atomic.Uint64
+	LoginTimeouts  atomic.Uint64
+	RateLimited    atomic.Uint64
+	SlowConsumers  atomic.Uint64
+}
+
+type LimiterStats struct {
+	Conns   int
+	Pending int
+
+	RefusedGlobal  uint64
+	RefusedPerIP   uint64
+	RefusedPending uint64
+	LoginTimeouts  uint64
+	RateLimited    uint64
+	SlowConsumers  uint64
+}
+
+func NewLimiter(cfg config.LimitsConfig) *Limiter {
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = DEFAULT_MAX_CONNS
+	}
+	if cfg.MaxConnsPerIP <= 0 {
+		cfg.MaxConnsPerIP = DEFAULT_MAX_CONNS_PER_IP
+	}
+	if cfg.MaxPendingLogins <= 0 {
+		cfg.MaxPendingLogins = DEFAULT_MAX_PENDING_LOGINS
+	}
+	if cfg.LoginTimeout <= 0 {
+		cfg.LoginTimeout = DEFAULT_LOGIN_TIMEOUT
+	}
+	if cfg.RequestRate <= 0 {
+		cfg.RequestRate = DEFAULT_REQUEST_RATE
+	}
+	if cfg.RequestBurst <= 0 {
+		cfg.RequestBurst = DEFAULT_REQUEST_BURST
+	}
+
+	return &Limiter{
+		cfg:   cfg,
+		perIP: make(map[string]int),
+	}
+}
+
+// MaxConnsPerIP returns the number of connections allowed from an IP
+func (l *Limiter) MaxConnsPerIP() int {
+	return l.cfg.MaxConnsPerIP
+}
+
+// addConn reserves a connection slot, and a pending login slot, for the IP.
+// Returns false if a limit is reached.
+func (l *Limiter) addConn(ip string) bool {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.conns >= l.cfg.MaxConns {
+		l.RefusedGlobal.Add(1)
+		return false
+	}
+	if l.perIP[ip] >= l.cfg.MaxConnsPerIP {
+		l.RefusedPerIP.Add(1)
+		return false
+	}
+	if l.pending >= l.cfg.MaxPendingLogins {
+		l.RefusedPending.Add(1)
+		return false
+	}
+
+	l.conns++
+	l.perIP[ip]++
+	l.pending++
+	return true
+}
+
+func (l *Limiter) removeConn(c *Connection) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if !c.loginDone.Swap(true) {
+		l.pending--
+	}
+
+	l.conns--
+	l.perIP[c.IP]--
+	if l.perIP[c.IP] <= 0 {
+		delete(l.perIP, c.IP)
+	}
+}
+
+// LoginDone frees the pending login slot of the connection
+func (l *Limiter) LoginDone(c *Connection) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if !c.loginDone.Swap(true) {
+		l.pending--
+	}
+}
+
+// LoginTimeout is the time a connection has to send its login request
+func (l *Limiter) LoginTimeout() time.Duration {
+	return time.Duration(l.cfg.LoginTimeout) * time.Second
+}
+
+// AllowRequest takes a token from the request bucket of the connection.
+// If it's empty, the request must be rejected. It must not be called concurrently for the same connection.
+func (l *Limiter) AllowRequest(c *Connection) bool {
+	now := time.Now()
+
+	if c.bucketTime.IsZero() {
+		c.bucketTokens = float64(l.cfg.RequestBurst)
+	} else {
+		c.bucketTokens += now.Sub(c.bucketTime).Seconds() * l.cfg.RequestRate
+		if c.bucketTokens > float64(l.cfg.RequestBurst) {
+			c.bucketTokens = float64(l.cfg.RequestBurst)
+		}
+	}
+	c.bucketTime = now
+
+	if c.bucketTokens < 1 {
+		l.RateLimited.Add(1)
+		return false
+	}
+	c.bucketTokens--
+	return true
+}
+
+func (l *Limiter) Stats() LimiterStats {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return LimiterStats{
+		Conns:          l.conns,
+		Pending:        l.pending,
+		RefusedGlobal:  l.RefusedGlobal.Load(),
+		RefusedPerIP:   l.RefusedPerIP.Load(),
+		RefusedPending: l.RefusedPending.Load(),
+		LoginTimeouts:  l.LoginTimeouts.Load(),
+		RateLimited:    l.RateLimited.Load(),
+		SlowConsumers:  l.SlowConsumers.Load(),
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go-pool/logger"
+)
+
+// ReadRequest reads a request of the submit loop. The usual submit and keepalived requests are
+// parsed without reflection nor allocations when req is reused for the requests of a connection;
+// anything else is parsed with encoding/json. The nonce and result are only valid until the next
+// call.
+func ReadRequest(req *RequestJob, reader *bufio.Reader) error {
+	data, isPrefix, err := reader.ReadLine()
+	if isPrefix {
+		logger.Warn("oversized request")
+		return fmt.Errorf("%w: oversize request", ErrMalformed)
+	} else if err != nil {
+		logger.Debug("Stratum server: error reading:", err)
+		return err
+	}
+	if logger.LogLevel >= 1 {
+		logger.Net("<<< " + string(data))
+	}
+
+	// the strings of the previous request are reused when they are equal, and the buffers of
+	// the nonce and result are reused
+	prev := *req
+	reset := func() {
+		*req = RequestJob{}
+		req.Params.Nonce = prev.Params.Nonce[:0]
+		req.Params.Result = prev.Params.Result[:0]
+	}
+
+	reset()
+	if parseRequestJob(data, req, &prev) {
+		return nil
+	}
+
+	reset()
+	err = json.Unmarshal(data, req)
+	if err != nil {
+		logger.Warn("failed to unmarshal json:", err)
+		return fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	return nil
+}
+
+// scanner is a minimal JSON scanner for flat objects with string and unsigned integer values
+type scanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *scanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// next skips the whitespace and consumes c. Returns false if the next byte is not c.
+func (s *scanner) next(c byte) bool {
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+// str reads a string without escape sequences. The result points into the scanned data.
+func (s *scanner) str() ([]byte, bool) {
+	if !s.next('"') {
+		return nil, false
+	}
+	start := s.pos
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		if c == '"' {
+			s.pos++
+			return s.data[start : s.pos-1], true
+		}
+		if c == '\\' || c < 0x20 {
+			return nil, false
+		}
+		s.pos++
+	}
+	return nil, false
+}
+
+func (s *scanner) uint() (uint64, bool) {
+	s.skipSpace()
+	start := s.pos
+	var n uint64
+	for s.pos < len(s.data) && s.data[s.pos] >= '0' && s.data[s.pos] <= '9' {
+		d := uint64(s.data[s.pos] - '0')
+		if n > (1<<64-1-d)/10 {
+			return 0, false
+		}
+		n = n*10 + d
+		s.pos++
+	}
+	// JSON numbers have no leading zeros
+	if s.pos == start || (s.data[start] == '0' && s.pos-start > 1) {
+		return 0, false
+	}
+	return n, true
+}
+
+// object calls fn for every key of an object, with the scanner positioned at the value
+func (s *scanner) object(fn func(key []byte) bool) bool {
+	if !s.next('{') {
+		return false
+	}
+	if s.next('}') {
+		return true
+	}
+	for {
+		key, ok := s.str()
+		if !ok || !s.next(':') || !fn(key) {
+			return false
+		}
+		if s.next('}') {
+			return true
+		}
+		if !s.next(',') {
+			return false
+		}
+	}
+}
+
+// intern returns prev if it's equal to b, so that the IDs repeated in every request of a
+// connection are not allocated again
+func intern(b []byte, prev string) string {
+	if string(b) == prev {
+		return prev
+	}
+	return string(b)
+}
+
+// parseRequestJob parses the requests sent by the miners in the submit loop. It returns false if
+// data is not in the usual form, in which case it must be parsed with encoding/json. The strings
+// of prev are reused.
+func parseRequestJob(data []byte, req, prev *RequestJob) bool {
+	s := scanner{data: data}
+
+	ok := s.object(func(key []byte) bool {
+		var ok bool
+		switch string(key) {
+		case "id":
+			req.ID, ok = s.uint()
+		case "method":
+			var m []byte
+			m, ok = s.str()
+			// the common methods don't allocate
+			switch string(m) {
+			case "submit":
+				req.Method = "submit"
+			case "keepalived":
+				req.Method = "keepalived"
+			case "getjob":
+				req.Method = "getjob"
+			default:
+				req.Method = string(m)
+			}
+		case "jsonrpc":
+			_, ok = s.str()
+		case "params":
+			ok = s.object(func(key []byte) bool {
+				v, ok := s.str()
+				switch string(key) {
+				case "id":
+					req.Params.ID = intern(v, prev.Params.ID)
+				case "job_id":
+					req.Params.JobID = intern(v, prev.Params.JobID)
+				case "nonce":
+					req.Params.Nonce = append(req.Params.Nonce, v...)
+				case "result":
+					req.Params.Result = append(req.Params.Result, v...)
+				case "algo", "rigid":
+				default:
+					// encoding/json matches keys case-insensitively
+					return false
+				}
+				return ok
+			})
+		}
+		return ok
+	})
+	if !ok {
+		return false
+	}
+
+	s.skipSpace()
+	return s.pos == len(s.data)
+}
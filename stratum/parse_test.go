@@ -0,0 +1,211 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"go-pool/config"
+	"strings"
+	"testing"
+)
+
+const testSubmit = `{"id":12,"jsonrpc":"2.0","method":"submit","params":{"id":"4f3c2a","job_id":"j1",` +
+	`"nonce":"deadbeef","result":"a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"}}`
+
+// equalRequest compares the requests, with empty and nil bytes being equal
+func equalRequest(a, b RequestJob) bool {
+	return a.ID == b.ID && a.Method == b.Method && a.Params.ID == b.Params.ID &&
+		a.Params.JobID == b.Params.JobID && bytes.Equal(a.Params.Nonce, b.Params.Nonce) &&
+		bytes.Equal(a.Params.Result, b.Params.Result)
+}
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		fast bool // parsed by parseRequestJob
+	}{
+		{"submit", testSubmit, true},
+		{"keepalived", `{"id":3,"method":"keepalived","params":{"id":"4f3c2a"}}`, true},
+		{"getjob", `{"id":4,"method":"getjob","params":{"id":"4f3c2a"}}`, true},
+		{"whitespace", " { \"id\" : 5 ,\t\"method\":\"submit\", \"params\" : { \"nonce\" : \"00000001\" } } ", true},
+		{"reordered keys", `{"params":{"result":"ff","nonce":"01020304","job_id":"j2","id":"s"},"method":"submit","id":7}`, true},
+		{"ignored params", `{"id":1,"method":"submit","params":{"id":"s","algo":"rx/0","rigid":"rig1"}}`, true},
+		{"empty params", `{"id":1,"method":"keepalived","params":{}}`, true},
+		{"escaped string", `{"id":8,"method":"submit","params":{"id":"a\"b","nonce":"deadbeef"}}`, false},
+		{"escaped method", `{"id":8,"method":"su\u0062mit","params":{}}`, false},
+		{"extra top-level key", `{"id":9,"method":"submit","extra":{"a":[1,2]},"params":{"nonce":"01020304"}}`, false},
+		{"extra param", `{"id":9,"method":"submit","params":{"nonce":"01020304","worker":"w"}}`, false},
+		{"uppercase param", `{"id":9,"method":"submit","params":{"Nonce":"01020304"}}`, false},
+		{"null id", `{"id":null,"method":"keepalived","params":{}}`, false},
+		{"big id", `{"id":18446744073709551615,"method":"keepalived"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fast RequestJob
+			if ok := parseRequestJob([]byte(tt.line), &fast, &RequestJob{}); ok != tt.fast {
+				t.Fatalf("parseRequestJob returned %v, expected %v", ok, tt.fast)
+			}
+
+			var expected RequestJob
+			err := json.Unmarshal([]byte(tt.line), &expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.fast && !equalRequest(fast, expected) {
+				t.Fatalf("fast path parsed %+v, expected %+v", fast, expected)
+			}
+
+			var req RequestJob
+			err = ReadRequest(&req, bufio.NewReader(strings.NewReader(tt.line+"\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalRequest(req, expected) {
+				t.Fatalf("parsed %+v, expected %+v", req, expected)
+			}
+		})
+	}
+}
+
+func TestReadRequestMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"not json", `hello`},
+		{"truncated", `{"id":1,"method":"submit"`},
+		{"trailing data", `{"id":1,"method":"submit"} {}`},
+		{"leading zero", `{"id":01,"method":"submit"}`},
+		{"id overflow", `{"id":18446744073709551616,"method":"submit"}`},
+		{"string id", `{"id":"1","method":"submit"}`},
+		{"oversized", `{"id":1,"method":"submit","params":{"nonce":"` + strings.Repeat("a", config.MAX_REQUEST_SIZE) + `"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req RequestJob
+			reader := bufio.NewReaderSize(strings.NewReader(tt.line+"\n"), config.MAX_REQUEST_SIZE)
+			err := ReadRequest(&req, reader)
+			if !errors.Is(err, ErrMalformed) {
+				t.Fatalf("expected ErrMalformed, got %v", err)
+			}
+		})
+	}
+}
+
+// a miner can send several requests before reading the replies
+func TestReadRequestPipelined(t *testing.T) {
+	lines := []string{
+		testSubmit,
+		`{"id":13,"method":"keepalived","params":{"id":"4f3c2a"}}`,
+		`{"id":14,"method":"submit","params":{"id":"4f3c2a","nonce":"00000002"}}`,
+		testSubmit,
+	}
+	reader := bufio.NewReaderSize(strings.NewReader(strings.Join(lines, "\n")+"\n"), config.MAX_REQUEST_SIZE)
+
+	// reused like in the submit loop, so the fields of the previous request must not be kept
+	var req RequestJob
+	for i, v := range lines {
+		var expected RequestJob
+		json.Unmarshal([]byte(v), &expected)
+
+		err := ReadRequest(&req, reader)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if !equalRequest(req, expected) {
+			t.Fatalf("request %d: parsed %+v, expected %+v", i, req, expected)
+		}
+	}
+}
+
+// lineReader returns the same line on every Read, like a miner submitting shares
+type lineReader struct {
+	line []byte
+}
+
+func (r *lineReader) Read(b []byte) (int, error) {
+	return copy(b, r.line), nil
+}
+
+// the shares of a connection are parsed without allocations
+func TestReadRequestAllocs(t *testing.T) {
+	reader := bufio.NewReaderSize(&lineReader{[]byte(testSubmit + "\n")}, config.MAX_REQUEST_SIZE)
+	var req RequestJob
+
+	// the first request allocates the IDs and the buffers
+	err := ReadRequest(&req, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		ReadRequest(&req, reader)
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per request", allocs)
+	}
+}
+
+func BenchmarkReadRequest(b *testing.B) {
+	reader := bufio.NewReaderSize(&lineReader{[]byte(testSubmit + "\n")}, config.MAX_REQUEST_SIZE)
+	var req RequestJob
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := ReadRequest(&req, reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadJSON(b *testing.B) {
+	reader := bufio.NewReaderSize(&lineReader{[]byte(testSubmit + "\n")}, config.MAX_REQUEST_SIZE)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := RequestJob{}
+		err := ReadJSON(&req, reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// the submit loop before the per-connection reader
+func BenchmarkReadJSONNewReader(b *testing.B) {
+	conn := &lineReader{[]byte(testSubmit + "\n")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := RequestJob{}
+		err := ReadJSON(&req, bufio.NewReaderSize(conn, config.MAX_REQUEST_SIZE))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
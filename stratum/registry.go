@@ -0,0 +1,191 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+const NUM_SHARDS = 64
+
+// Registry is the set of the connections of a Server, by id, with indexes by IP and payout address.
+// It is safe for concurrent use. The zero value is ready to use.
+type Registry struct {
+	shards [NUM_SHARDS]registryShard
+
+	byIP      index
+	byAddress index
+
+	count atomic.Int64
+}
+
+type registryShard struct {
+	conns map[uint64]*Connection
+
+	sync.RWMutex
+}
+
+// index is a sharded multimap from a string to connections
+type index struct {
+	shards [NUM_SHARDS]indexShard
+}
+
+type indexShard struct {
+	m map[string]map[uint64]*Connection
+
+	sync.RWMutex
+}
+
+var indexSeed = maphash.MakeSeed()
+
+func (x *index) shard(key string) *indexShard {
+	return &x.shards[maphash.String(indexSeed, key)%NUM_SHARDS]
+}
+
+func (x *index) add(key string, c *Connection) {
+	s := x.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.m == nil {
+		s.m = make(map[string]map[uint64]*Connection)
+	}
+	if s.m[key] == nil {
+		s.m[key] = make(map[uint64]*Connection)
+	}
+	s.m[key][c.Id] = c
+}
+
+func (x *index) remove(key string, id uint64) {
+	s := x.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.m[key], id)
+	if len(s.m[key]) == 0 {
+		delete(s.m, key)
+	}
+}
+
+func (x *index) get(key string) []*Connection {
+	s := x.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]*Connection, 0, len(s.m[key]))
+	for _, c := range s.m[key] {
+		list = append(list, c)
+	}
+	return list
+}
+
+func (r *Registry) shard(id uint64) *registryShard {
+	return &r.shards[id%NUM_SHARDS]
+}
+
+// Add adds a connection. Its id must be unique.
+func (r *Registry) Add(c *Connection) {
+	s := r.shard(c.Id)
+	s.Lock()
+	if s.conns == nil {
+		s.conns = make(map[uint64]*Connection)
+	}
+	s.conns[c.Id] = c
+	s.Unlock()
+
+	r.count.Add(1)
+	r.byIP.add(c.IP, c)
+}
+
+// Remove removes the connection with the given id. Returns false if it was not in the registry,
+// so that only one of several concurrent calls removes it.
+func (r *Registry) Remove(id uint64) (*Connection, bool) {
+	s := r.shard(id)
+	s.Lock()
+	c, ok := s.conns[id]
+	delete(s.conns, id)
+	s.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	r.count.Add(-1)
+	r.byIP.remove(c.IP, id)
+	if addr := c.Address(); addr != "" {
+		r.byAddress.remove(addr, id)
+	}
+	return c, true
+}
+
+// SetAddress sets the payout address of a connection, after its login
+func (r *Registry) SetAddress(c *Connection, addr string) {
+	// locked so that Remove sees the address, if it's called meanwhile
+	s := r.shard(c.Id)
+	s.Lock()
+	defer s.Unlock()
+
+	if old := c.Address(); old != "" {
+		r.byAddress.remove(old, c.Id)
+	}
+	c.address.Store(addr)
+
+	if _, ok := s.conns[c.Id]; ok {
+		r.byAddress.add(addr, c)
+	}
+}
+
+func (r *Registry) Get(id uint64) (*Connection, bool) {
+	s := r.shard(id)
+	s.RLock()
+	defer s.RUnlock()
+
+	c, ok := s.conns[id]
+	return c, ok
+}
+
+// Len returns the number of connections
+func (r *Registry) Len() int {
+	return int(r.count.Load())
+}
+
+// All returns a snapshot of the connections
+func (r *Registry) All() []*Connection {
+	list := make([]*Connection, 0, r.Len())
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.RLock()
+		for _, c := range s.conns {
+			list = append(list, c)
+		}
+		s.RUnlock()
+	}
+	return list
+}
+
+// ByIP returns the connections from an IP
+func (r *Registry) ByIP(ip string) []*Connection {
+	return r.byIP.get(ip)
+}
+
+// ByAddress returns the connections mining to a payout address
+func (r *Registry) ByAddress(addr string) []*Connection {
+	return r.byAddress.get(addr)
+}
@@ -0,0 +1,306 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"encoding/json"
+	"errors"
+	"go-pool/config"
+	"go-pool/logger"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const DEFAULT_RESUME_WINDOW = 15 * 60 // seconds
+
+// the resume cache is saved, and reloaded if another slave changed it, this often
+const RESUME_SAVE_INTERVAL = 10 * time.Second
+
+// the logins check if the file was changed at most this often
+const RESUME_RELOAD_INTERVAL = time.Second
+
+// ResumeState is what is remembered of a miner between its connections
+type ResumeState struct {
+	Key      string  `json:"key"`
+	NextDiff float64 `json:"next_diff"`
+	Score    int32   `json:"score"`
+	Nicehash bool    `json:"nicehash"`
+	Updated  int64   `json:"updated"` // unix seconds
+}
+
+// ResumeCache remembers the difficulty, trust score and NiceHash mode of the recent miners, so
+// that they don't start over when they reconnect. It is saved to a file, to survive restarts.
+// The changes made to the file by another slave (while it's shutting down, for example) are merged.
+// A nil ResumeCache remembers nothing.
+type ResumeCache struct {
+	states map[string]ResumeState
+
+	window    int64
+	path      string
+	modTime   time.Time
+	changed   bool
+	lastCheck time.Time // of the file by a login
+
+	sync.Mutex
+	ioMut sync.Mutex // the file is read and written without holding the lock
+}
+
+// ResumeKey is the key of a miner in the ResumeCache
+func ResumeKey(addr, worker, ip string) string {
+	return addr + "/" + worker + "/" + ip
+}
+
+// NewResumeCache loads the cache saved at path. Returns nil if resumption is disabled.
+func NewResumeCache(path string, cfg config.ResumeConfig) (*ResumeCache, error) {
+	if cfg.Window < 0 {
+		return nil, nil
+	}
+	if cfg.Window == 0 {
+		cfg.Window = DEFAULT_RESUME_WINDOW
+	}
+
+	r := &ResumeCache{
+		states: make(map[string]ResumeState),
+		window: cfg.Window,
+		path:   path,
+	}
+
+	list, modTime, err := readResume(path)
+	if err != nil {
+		return nil, err
+	}
+	r.merge(list, modTime)
+
+	return r, nil
+}
+
+// readResume reads the states saved at path, and the modification time of the file
+func readResume(path string) ([]ResumeState, time.Time, error) {
+	st, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, time.Time{}, nil
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var list []ResumeState
+	err = json.Unmarshal(data, &list)
+	return list, st.ModTime(), err
+}
+
+// merge adds the states read from the file, keeping the most recent state of each miner. The
+// cache is saved again if the file lacks some of its states.
+func (r *ResumeCache) merge(list []ResumeState, modTime time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now().Unix()
+	inFile := 0
+	for _, v := range list {
+		if v.Updated+r.window > now && v.Updated >= r.states[v.Key].Updated {
+			r.states[v.Key] = v
+			inFile++
+		}
+	}
+	if inFile != len(r.states) {
+		r.changed = true
+	}
+	r.modTime = modTime
+}
+
+// reload loads the file again if another slave changed it.
+// r.ioMut must be locked
+func (r *ResumeCache) reload() {
+	r.Lock()
+	modTime := r.modTime
+	r.Unlock()
+
+	st, err := os.Stat(r.path)
+	if err != nil || st.ModTime().Equal(modTime) {
+		return
+	}
+
+	logger.Debug("Resume cache changed, reloading")
+	list, modTime, err := readResume(r.path)
+	if err != nil {
+		logger.Error("could not reload resume cache:", err)
+		return
+	}
+	r.merge(list, modTime)
+}
+
+// Save writes the cache to its file, if it was changed
+func (r *ResumeCache) Save() {
+	if r == nil {
+		return
+	}
+
+	r.ioMut.Lock()
+	defer r.ioMut.Unlock()
+
+	r.Lock()
+	if !r.changed {
+		r.Unlock()
+		return
+	}
+	list := make([]ResumeState, 0, len(r.states))
+	for _, v := range r.states {
+		list = append(list, v)
+	}
+	r.changed = false
+	r.Unlock()
+
+	data, err := json.Marshal(list)
+	if err == nil {
+		var modTime time.Time
+		modTime, err = replaceFile(r.path, data)
+		if err == nil {
+			r.Lock()
+			r.modTime = modTime
+			r.Unlock()
+			return
+		}
+	}
+
+	logger.Error("could not save resume cache:", err)
+	r.Lock()
+	r.changed = true
+	r.Unlock()
+}
+
+// replaceFile replaces the file at path with data, and returns its new modification time. It's
+// written to a temporary file first, so that a crash doesn't leave a truncated file, and two
+// processes can write it at the same time.
+func replaceFile(path string, data []byte) (time.Time, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return time.Time{}, err
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return st.ModTime(), nil
+}
+
+// Run removes the expired states, reloads the file if it was changed by another slave, and saves
+// the cache periodically. It never returns.
+func (r *ResumeCache) Run() {
+	for {
+		time.Sleep(RESUME_SAVE_INTERVAL)
+
+		r.ioMut.Lock()
+		r.reload()
+		r.ioMut.Unlock()
+
+		r.Lock()
+		now := time.Now().Unix()
+		for i, v := range r.states {
+			if v.Updated+r.window <= now {
+				delete(r.states, i)
+				r.changed = true
+			}
+		}
+		r.Unlock()
+
+		r.Save()
+	}
+}
+
+// Get returns the state of a miner, if it was stored within the window. The file is reloaded first
+// if it changed, so that the miners disconnected by a slave that is shutting down find their state
+// right away. It's checked at most every RESUME_RELOAD_INTERVAL, and not while it's being saved.
+func (r *ResumeCache) Get(key string) (ResumeState, bool) {
+	if r == nil {
+		return ResumeState{}, false
+	}
+
+	r.Lock()
+	check := time.Since(r.lastCheck) >= RESUME_RELOAD_INTERVAL
+	if check {
+		r.lastCheck = time.Now()
+	}
+	r.Unlock()
+
+	if check && r.ioMut.TryLock() {
+		r.reload()
+		r.ioMut.Unlock()
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	s, ok := r.states[key]
+	if !ok || s.Updated+r.window <= time.Now().Unix() {
+		return ResumeState{}, false
+	}
+	return s, true
+}
+
+// Store remembers the state of the connection.
+// Connection must be locked.
+func (r *ResumeCache) Store(key string, c *Connection) {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.states[key] = ResumeState{
+		Key:      key,
+		NextDiff: c.NextDiff,
+		Score:    c.Score,
+		Nicehash: c.Nicehash,
+		Updated:  time.Now().Unix(),
+	}
+	r.changed = true
+}
+
+// Len returns the number of remembered miners
+func (r *ResumeCache) Len() int {
+	if r == nil {
+		return 0
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	return len(r.states)
+}
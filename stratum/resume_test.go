@@ -0,0 +1,85 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"go-pool/config"
+	"path/filepath"
+	"testing"
+)
+
+// a slave that is shutting down saves the states, and the new slave finds them on login
+func TestResumeHandover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resume.json")
+
+	old, err := NewResumeCache(path, config.ResumeConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err := NewResumeCache(path, config.ResumeConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new slave already checked the file once
+	if _, ok := running.Get("a/w/1.2.3.4"); ok {
+		t.Fatal("unknown miner resumed")
+	}
+
+	old.Store("a/w/1.2.3.4", &Connection{NextDiff: 12345, Score: 7})
+	old.Save()
+
+	// not checked again within RESUME_RELOAD_INTERVAL
+	running.Lock()
+	running.lastCheck = running.lastCheck.Add(-RESUME_RELOAD_INTERVAL)
+	running.Unlock()
+
+	s, ok := running.Get("a/w/1.2.3.4")
+	if !ok || s.NextDiff != 12345 || s.Score != 7 {
+		t.Fatalf("resumed %+v, %v", s, ok)
+	}
+
+	// the old slave saves again without the state stored by the new one, which saves it again
+	running.Store("b/w/1.2.3.4", &Connection{NextDiff: 1000})
+	running.Save()
+	old.Store("a/w/1.2.3.4", &Connection{NextDiff: 23456})
+	old.Save()
+
+	running.ioMut.Lock()
+	running.reload()
+	running.ioMut.Unlock()
+	running.Save()
+
+	saved, err := NewResumeCache(path, config.ResumeConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Len() != 2 {
+		t.Fatalf("%d states saved, expected 2", saved.Len())
+	}
+	if s, _ := saved.Get("a/w/1.2.3.4"); s.NextDiff != 23456 {
+		t.Fatalf("saved %+v", s)
+	}
+}
+
+func TestReplaceFileError(t *testing.T) {
+	_, err := replaceFile(filepath.Join(t.TempDir(), "missing", "resume.json"), []byte("[]"))
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"errors"
+	"go-pool/logger"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// messages waiting to be written to a connection. A miner that doesn't read them fast enough is
+// disconnected.
+const SEND_QUEUE_SIZE = 32
+
+const WRITE_TIMEOUT = 20 * time.Second
+
+// time given to write the queued messages, like error replies, when a connection is closed
+const FLUSH_TIMEOUT = time.Second
+
+var ErrSlowConsumer = errors.New("send queue is full")
+var ErrClosed = errors.New("connection closed")
+
+// writer writes the messages of the send queue of c. When c is closed, the queued messages are
+// flushed and the network connection is closed.
+func (s *Server) writer(c *Connection) {
+	defer c.Conn.Close()
+
+	for {
+		select {
+		case data := <-c.sendQueue:
+			c.Conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			_, err := c.Conn.Write(data)
+			if err != nil {
+				logger.Debug("write to", c.IP, "failed:", err)
+				c.Close()
+				return
+			}
+		case <-c.closed:
+			c.Conn.SetWriteDeadline(time.Now().Add(FLUSH_TIMEOUT))
+			for {
+				select {
+				case data := <-c.sendQueue:
+					_, err := c.Conn.Write(data)
+					if err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close closes the connection, after the queued messages are written. The miner is removed from
+// the server by its handler, when reading from the connection fails.
+func (c *Connection) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+// Broadcast calls fn for every connection, with the connection locked, and returns when all the
+// calls are done. The calls are spread over several goroutines, so a slow one doesn't delay the
+// others. The time it took is returned.
+func (s *Server) Broadcast(fn func(c *Connection)) time.Duration {
+	start := time.Now()
+
+	conns := s.Conns.All()
+
+	workers := runtime.NumCPU() * 2
+	if workers > len(conns) {
+		workers = len(conns)
+	}
+
+	ch := make(chan *Connection)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for c := range ch {
+				c.Lock()
+				fn(c)
+				c.Unlock()
+			}
+		}()
+	}
+	for _, c := range conns {
+		ch <- c
+	}
+	close(ch)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	s.lastBroadcast.Store(int64(elapsed))
+	return elapsed
+}
+
+// BroadcastLatency returns the duration of the last Broadcast
+func (s *Server) BroadcastLatency() time.Duration {
+	return time.Duration(s.lastBroadcast.Load())
+}
@@ -19,38 +19,67 @@ package stratum
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"go-pool/config"
 	"go-pool/logger"
 	"go-pool/p2pool"
-	"go-pool/util"
+	"go-pool/proxyproto"
+	"go-pool/template"
 	"net"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
-	Connections []*Connection
-	ConnsMut    sync.RWMutex
+	Conns Registry
 
 	NewConnections chan *Connection
 
+	Bans   *BanManager  // if nil, no peer is refused
+	Resume *ResumeCache // if nil, the miners start over on every connection
+	Limits *Limiter
+
+	Certs *CertStore // required by the TLS listeners
+
+	lastBroadcast atomic.Int64 // duration of the last Broadcast
+
+	listeners []net.Listener
+	closing   bool // set by Close
+
+	Vardiff         Vardiff // if nil, DefaultVardiff is used
+	RetargetPercent float64 // see config.VardiffConfig
+
 	sync.Mutex
 }
 
 type Connection struct {
-	Conn net.Conn
-	Id   uint64
+	Conn      net.Conn
+	Reader    *bufio.Reader // the only reader of Conn, so that pipelined requests are not lost
+	Id        uint64
+	IP        string
+	SessionID string // sent to the miner at login, and checked on submit
+
+	server  *Server
+	address atomic.Value // string, set with Registry.SetAddress
 
-	IsTls bool
+	IsTls    bool
+	Listener *config.ListenerConfig // the listener the miner connected to
 
 	CurrentJob ConnJob
-	LastJob    ConnJob
+	// ring of the previous jobs, so that shares submitted after a new job was sent are verified
+	// against the template they were found for
+	OldJobs       [NUM_OLD_JOBS]ConnJob
+	oldJobsPos    int
+	expiredJobIDs [NUM_EXPIRED_JOB_IDS]string
+	expiredPos    int
 
 	NextDiff  float64
 	LastShare int64 // in unix milliseconds
@@ -58,9 +87,30 @@ type Connection struct {
 	Nicehash  bool
 	P2Pool    p2pool.P2PoolClient
 
+	loginDone atomic.Bool
+
+	sendQueue chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	vardiffWindow []vardiffShare // see WindowVardiff
+
+	// request token bucket, see Limiter.AllowRequest
+	bucketTokens float64
+	bucketTime   time.Time
+
 	sync.RWMutex
 }
 
+// number of previous jobs kept for each connection
+const NUM_OLD_JOBS = 4
+
+// number of job ids remembered after being removed from OldJobs, to report stale shares
+const NUM_EXPIRED_JOB_IDS = 16
+
+var ErrStaleJob = errors.New("stale job")
+var ErrUnknownJob = errors.New("unknown job id")
+
 type ConnJob struct {
 	Blob        []byte // Blocktemplate blob
 	HashingBlob []byte // Blockhashing blob
@@ -69,6 +119,62 @@ type ConnJob struct {
 	JobID string
 
 	NicehashByte byte
+
+	Submitted map[uint32]struct{} // nonces of the shares accepted for this job
+
+	// context of the template the job was built from
+	Height       uint64 // height of the block being mined
+	SeedHash     string
+	MajorVersion uint
+	NetDiff      template.WideDiff
+	Reward       uint64
+}
+
+// Address returns the payout address of the miner, or "" before the login
+func (c *Connection) Address() string {
+	addr, _ := c.address.Load().(string)
+	return addr
+}
+
+// PushJob makes j the current job. The previous current job is kept in OldJobs.
+// Connection must be locked.
+func (c *Connection) PushJob(j ConnJob) {
+	if j.Submitted == nil {
+		j.Submitted = make(map[uint32]struct{})
+	}
+
+	if c.CurrentJob.JobID != "" {
+		if expired := c.OldJobs[c.oldJobsPos].JobID; expired != "" {
+			c.expiredJobIDs[c.expiredPos] = expired
+			c.expiredPos = (c.expiredPos + 1) % NUM_EXPIRED_JOB_IDS
+		}
+		c.OldJobs[c.oldJobsPos] = c.CurrentJob
+		c.oldJobsPos = (c.oldJobsPos + 1) % NUM_OLD_JOBS
+	}
+
+	c.CurrentJob = j
+}
+
+// FindJob returns the current or old job with the given id. If the job is too old, ErrStaleJob is returned.
+// Connection must be locked.
+func (c *Connection) FindJob(id string) (ConnJob, error) {
+	if id == "" {
+		return ConnJob{}, ErrUnknownJob
+	}
+	if c.CurrentJob.JobID == id {
+		return c.CurrentJob, nil
+	}
+	for _, v := range c.OldJobs {
+		if v.JobID == id {
+			return v, nil
+		}
+	}
+	for _, v := range c.expiredJobIDs {
+		if v == id {
+			return ConnJob{}, ErrStaleJob
+		}
+	}
+	return ConnJob{}, ErrUnknownJob
 }
 
 func (c *Connection) Send(a any) error {
@@ -76,17 +182,33 @@ func (c *Connection) Send(a any) error {
 	if err != nil {
 		panic(err)
 	}
-	c.SendBytes(data)
-	return nil
+	return c.SendBytes(data)
 }
+
+// SendBytes queues a message. It never blocks: if the send queue is full, the connection is
+// closed and ErrSlowConsumer is returned.
 func (c *Connection) SendBytes(data []byte) error {
 	logger.Net(">>>", string(data))
-	c.Conn.SetWriteDeadline(time.Now().Add(20 * time.Second))
-	_, err := c.Conn.Write(append(data, '\n'))
-	if err != nil {
-		return err
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+
+	// the caller can reuse data once SendBytes returns
+	msg := make([]byte, len(data)+1)
+	copy(msg, data)
+	msg[len(data)] = '\n'
+
+	select {
+	case c.sendQueue <- msg:
+		return nil
+	default:
+		logger.Warn("Disconnecting slow miner", c.IP)
+		c.server.Limits.SlowConsumers.Add(1)
+		c.Close()
+		return ErrSlowConsumer
 	}
-	return nil
 }
 
 func randomUint64() uint64 {
@@ -96,109 +218,203 @@ func randomUint64() uint64 {
 	return binary.BigEndian.Uint64(b)
 }
 
-func (s *Server) Start(port uint16, port_tls uint16) {
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Start listens on all the listeners. It never returns, unless the server is closed while it starts.
+func (s *Server) Start(listeners []config.ListenerConfig) {
 	s.NewConnections = make(chan *Connection, 1)
+	if s.Limits == nil {
+		s.Limits = NewLimiter(config.LimitsConfig{})
+	}
+	if s.Vardiff == nil {
+		s.Vardiff = DefaultVardiff{}
+	}
 
-	go func() {
-		cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
-		if err != nil {
-			logger.Error("Invalid TLS certificate:", err, "generating a new one")
+	trusted, err := proxyproto.ParseTrusted(config.Cfg.SlaveConfig.TrustedProxies)
+	if err != nil {
+		logger.Fatal("invalid trusted_proxies:", err)
+	}
 
-			certPem, keyPem, err := GenCertificate()
-			if err != nil {
-				logger.Fatal(err)
-			}
+	go s.kickBanned()
 
-			cert, err = tls.X509KeyPair(certPem, keyPem)
-			if err != nil {
-				logger.Fatal(err)
-			}
+	for i := range listeners {
+		l := &listeners[i]
 
+		lc := net.ListenConfig{}
+		if config.Cfg.SlaveConfig.ReusePort {
+			// another slave can listen on the same port, see README
+			lc.Control = reusePort
 		}
-		listener_tls, err := tls.Listen("tcp", "0.0.0.0:"+strconv.FormatUint(uint64(port_tls), 10), &tls.Config{
-			Certificates: []tls.Certificate{
-				cert,
-			},
-		})
+		listener, err := lc.Listen(context.Background(), "tcp", l.Bind)
 		if err != nil {
 			panic(err)
 		}
-		logger.Info("Stratum TLS server listening on port", port_tls)
-		for {
-			c, err := listener_tls.Accept()
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
 
-			conn := &Connection{
-				Conn:  c,
-				IsTls: true,
-				Id:    randomUint64(),
+		// the PROXY header is sent before the TLS handshake.
+		// WebSocket proxies use X-Forwarded-For instead.
+		if !l.WebSocket {
+			listener = proxyproto.NewListener(listener, trusted)
+		}
+
+		s.Lock()
+		if s.closing {
+			s.Unlock()
+			listener.Close()
+			return
+		}
+		s.listeners = append(s.listeners, listener)
+		s.Unlock()
+
+		if l.Tls {
+			if s.Certs == nil {
+				panic("stratum: TLS listener without a certificate store")
 			}
-			go s.handleConnection(conn)
+			listener = tls.NewListener(listener, s.Certs.TLSConfig())
 		}
-	}()
+		logger.Info("Stratum server listening on", l.Bind, "tls:", l.Tls, "websocket:", l.WebSocket, l.Desc)
 
-	listener, err := net.Listen("tcp", "0.0.0.0:"+strconv.FormatUint(uint64(port), 10))
-	if err != nil {
-		panic(err)
+		if l.WebSocket {
+			go s.serveWebSocket(listener, l, trusted)
+		} else {
+			go s.serve(listener, l)
+		}
 	}
 
-	logger.Info("Stratum server listening on port", port)
+	select {}
+}
 
+func (s *Server) serve(listener net.Listener, l *config.ListenerConfig) {
 	for {
 		c, err := listener.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			logger.Error(err)
 			continue
 		}
-		minerIp := util.RemovePort(c.RemoteAddr().String())
 
-		logger.Debug("new incoming connection with IP", minerIp)
+		s.accept(c, l)
+	}
+}
+
+func (s *Server) accept(c net.Conn, l *config.ListenerConfig) {
+	minerIp, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		minerIp = c.RemoteAddr().String()
+	}
+
+	logger.Debug("new incoming connection with IP", minerIp)
+
+	if ban, ok := s.Bans.IsBanned(minerIp); ok {
+		logger.Debug("refusing banned IP", minerIp+":", ban.Reason)
+		c.Close()
+		return
+	}
+	if s.Bans.OnConnect(minerIp, s.Limits.MaxConnsPerIP()) {
+		c.Close()
+		return
+	}
+	if !s.Limits.addConn(minerIp) {
+		logger.Debug("refusing connection from", minerIp+": too many connections")
+		c.Close()
+		return
+	}
+
+	conn := &Connection{
+		IsTls:     l.Tls,
+		Listener:  l,
+		Conn:      c,
+		Reader:    bufio.NewReaderSize(c, config.MAX_REQUEST_SIZE),
+		Id:        randomUint64(),
+		IP:        minerIp,
+		SessionID: newSessionID(),
+
+		server:    s,
+		sendQueue: make(chan []byte, SEND_QUEUE_SIZE),
+		closed:    make(chan struct{}),
+	}
+	go s.writer(conn)
+	go s.handleConnection(conn)
+}
+
+// Close stops accepting connections. The connected miners are not disconnected.
+func (s *Server) Close() {
+	s.Lock()
+	defer s.Unlock()
 
-		conn := &Connection{
-			IsTls: false,
-			Conn:  c,
-			Id:    randomUint64(),
+	s.closing = true
+	for _, v := range s.listeners {
+		err := v.Close()
+		if err != nil {
+			logger.Warn("could not close listener:", err)
 		}
-		go s.handleConnection(conn)
 	}
+	s.listeners = nil
 }
 
-// Note: srv.ConnsMut must be locked before calling this
+// Kick disconnects a miner and removes it from the server. It can safely be called several times.
 func (s *Server) Kick(id uint64) {
-	var connectionsNew = make([]*Connection, 0, len(s.Connections))
+	c, ok := s.Conns.Remove(id)
+	if !ok {
+		return
+	}
 
-	for _, v := range s.Connections {
-		if v.Id == id {
-			v.Conn.Close()
+	c.Close()
+	s.Limits.removeConn(c)
 
-			if config.Cfg.UseP2Pool && v.P2Pool.Jobs != nil {
-				// terminate the p2pool connection
-				v.P2Pool.Stop()
-			}
-		} else {
-			connectionsNew = append(connectionsNew, v)
+	if config.Cfg.UseP2Pool && c.P2Pool.Jobs != nil {
+		// terminate the p2pool connection
+		c.P2Pool.Stop()
+	}
+}
+
+// KickBanned disconnects the miners of the IP and of the address, if they are banned
+func (s *Server) KickBanned(ip, addr string) {
+	if _, ok := s.Bans.IsBanned(ip); ok {
+		for _, c := range s.Conns.ByIP(ip) {
+			logger.Info("Kicking banned IP", ip)
+			s.Kick(c.Id)
+		}
+	}
+	if _, ok := s.Bans.IsBanned(addr); ok && addr != "" {
+		for _, c := range s.Conns.ByAddress(addr) {
+			logger.Info("Kicking banned address", addr)
+			s.Kick(c.Id)
 		}
 	}
-	s.Connections = connectionsNew
 }
 
-func (srv *Server) handleConnection(conn *Connection) {
-	srv.ConnsMut.Lock()
-	srv.Connections = append(srv.Connections, conn)
-	srv.ConnsMut.Unlock()
+// kickBanned disconnects the miners whose IP or address was banned while they were connected
+func (s *Server) kickBanned() {
+	for {
+		time.Sleep(10 * time.Second)
+
+		for _, v := range s.Conns.All() {
+			s.KickBanned(v.IP, v.Address())
+		}
+	}
+}
+
+func (s *Server) handleConnection(conn *Connection) {
+	s.Conns.Add(conn)
 	logger.Debug("handling connection")
 
-	srv.NewConnections <- conn
+	s.NewConnections <- conn
 }
 
+// ErrMalformed is returned by ReadJSON when the request is oversized or not valid JSON
+var ErrMalformed = errors.New("malformed request")
+
 func ReadJSON(response interface{}, reader *bufio.Reader) error {
 	data, isPrefix, err := reader.ReadLine()
 	if isPrefix {
 		logger.Warn("oversized request")
-		return errors.New("oversize request")
+		return fmt.Errorf("%w: oversize request", ErrMalformed)
 	} else if err != nil {
 		logger.Debug("Stratum server: error reading:", err)
 		return err
@@ -207,7 +423,7 @@ func ReadJSON(response interface{}, reader *bufio.Reader) error {
 	err = json.Unmarshal(data, response)
 	if err != nil {
 		logger.Warn("failed to unmarshal json:", err)
-		return err
+		return fmt.Errorf("%w: %w", ErrMalformed, err)
 	}
 	return nil
 }
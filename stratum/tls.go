@@ -0,0 +1,181 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-pool/config"
+	"go-pool/logger"
+	"os"
+	"sync"
+	"time"
+)
+
+const DEFAULT_CERT_FILE = "cert.pem"
+const DEFAULT_KEY_FILE = "key.pem"
+
+// CertStore keeps the TLS certificates of the stratum server. The certificates are reloaded
+// when the files change, or when Reload is called.
+type CertStore struct {
+	cfg        config.TlsConfig
+	minVersion uint16
+
+	certs       []*tls.Certificate // the first one is the default certificate
+	fingerprint string
+	modTimes    []time.Time
+
+	sync.RWMutex
+}
+
+// NewCertStore loads the certificates of cfg. If the default certificate doesn't exist, a
+// self-signed one is generated.
+func NewCertStore(cfg config.TlsConfig) (*CertStore, error) {
+	if cfg.CertFile == "" {
+		cfg.CertFile = DEFAULT_CERT_FILE
+	}
+	if cfg.KeyFile == "" {
+		cfg.KeyFile = DEFAULT_KEY_FILE
+	}
+
+	s := &CertStore{
+		cfg: cfg,
+	}
+
+	switch cfg.MinVersion {
+	case "", "1.2":
+		s.minVersion = tls.VersionTLS12
+	case "1.3":
+		s.minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported TLS min_version %s", cfg.MinVersion)
+	}
+
+	_, err := os.Stat(cfg.CertFile)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Warn("TLS certificate", cfg.CertFile, "not found, generating a self-signed one")
+
+		_, _, err = GenCertificate(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, s.Reload()
+}
+
+// the certificate and key files, default first
+func (s *CertStore) files() []config.TlsCertificate {
+	return append([]config.TlsCertificate{{
+		CertFile: s.cfg.CertFile,
+		KeyFile:  s.cfg.KeyFile,
+	}}, s.cfg.Sni...)
+}
+
+// Reload loads the certificates again. If one of them is invalid, the old ones are kept.
+func (s *CertStore) Reload() error {
+	files := s.files()
+
+	certs := make([]*tls.Certificate, 0, len(files))
+	modTimes := make([]time.Time, 0, len(files))
+	for _, v := range files {
+		st, err := os.Stat(v.CertFile)
+		if err != nil {
+			return err
+		}
+
+		cert, err := tls.LoadX509KeyPair(v.CertFile, v.KeyFile)
+		if err != nil {
+			return fmt.Errorf("invalid TLS certificate %s: %w", v.CertFile, err)
+		}
+		certs = append(certs, &cert)
+		modTimes = append(modTimes, st.ModTime())
+	}
+
+	hash := sha256.Sum256(certs[0].Certificate[0])
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.certs = certs
+	s.modTimes = modTimes
+	s.fingerprint = hex.EncodeToString(hash[:])
+
+	logger.Info("Loaded", len(certs), "TLS certificates, fingerprint", s.fingerprint)
+
+	return nil
+}
+
+// Run reloads the certificates when their files change. It never returns.
+func (s *CertStore) Run() {
+	for {
+		time.Sleep(10 * time.Second)
+
+		s.RLock()
+		changed := false
+		for i, v := range s.files() {
+			st, err := os.Stat(v.CertFile)
+			if err == nil && !st.ModTime().Equal(s.modTimes[i]) {
+				changed = true
+				break
+			}
+		}
+		s.RUnlock()
+
+		if changed {
+			logger.Info("TLS certificate changed, reloading")
+			err := s.Reload()
+			if err != nil {
+				logger.Error("could not reload TLS certificates:", err)
+			}
+		}
+	}
+}
+
+// Fingerprint returns the hex SHA-256 of the default certificate
+func (s *CertStore) Fingerprint() string {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.fingerprint
+}
+
+func (s *CertStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if hello.ServerName != "" {
+		for _, v := range s.certs[1:] {
+			if hello.SupportsCertificate(v) == nil {
+				return v, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+// TLSConfig returns the server TLS config, which always uses the current certificates
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     s.minVersion,
+		GetCertificate: s.getCertificate,
+	}
+}
@@ -22,6 +22,20 @@ import (
 	"go-pool/template"
 )
 
+// Stratum error codes, see unique_error_codes.md
+const (
+	ERR_DUPLICATE_SHARE  = 2001
+	ERR_SERVER_BUSY      = 2002
+	ERR_STALE_SHARE      = 2003
+	ERR_BANNED           = 2004
+	ERR_RATE_LIMITED     = 2005
+	ERR_UNAUTHENTICATED  = 2006
+	ERR_UNSUPPORTED_ALGO = 2007
+
+	// JSON-RPC 2.0
+	ERR_METHOD_NOT_FOUND = -32601
+)
+
 type MinedShare struct {
 	RequestID uint64
 	ID        string
@@ -30,10 +44,23 @@ type MinedShare struct {
 	Result    string
 }
 type JobResultRequest struct {
-	ID     string `json:"id"`
-	JobID  string `json:"job_id"`
-	Nonce  string `json:"nonce"`
-	Result string `json:"result"`
+	ID     string      `json:"id"`
+	JobID  string      `json:"job_id"`
+	Nonce  StringBytes `json:"nonce"`
+	Result StringBytes `json:"result"`
+}
+
+// StringBytes is a JSON string kept as bytes, so that its buffer is reused by the next request
+type StringBytes []byte
+
+func (b *StringBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	*b = append((*b)[:0], s...)
+	return nil
 }
 
 type RequestGeneric struct {
@@ -57,6 +84,7 @@ type loginReq struct {
 	Pass            string   `json:"pass"`
 	Agent           string   `json:"agent"`
 	Algo            []string `json:"algo"`
+	Rigid           string   `json:"rigid"`
 	NicehashSupport bool     `json:"nicehash_support"` // Non-standard. Not supported by XMRIG.
 }
 type Response struct {
@@ -0,0 +1,124 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"fmt"
+	"go-pool/config"
+	"math"
+	"time"
+)
+
+const DEFAULT_WINDOW_SIZE = 16
+const DEFAULT_RETARGET_PERCENT = 50
+
+// the window algorithm changes the difficulty by at most this factor per share
+const MAX_WINDOW_STEP = 4
+
+// Vardiff computes the difficulty of the connections from their shares
+type Vardiff interface {
+	// NextDiff is called for each accepted share of difficulty shareDiff, before c.LastShare is
+	// updated. It returns the new target difficulty of c, which is then limited by the caller.
+	// Connection must be locked.
+	NextDiff(c *Connection, shareDiff uint64, targetTime uint64) float64
+}
+
+// NewVardiff returns the vardiff algorithm of the config
+func NewVardiff(cfg config.VardiffConfig) (Vardiff, error) {
+	switch cfg.Algorithm {
+	case "", "default":
+		return DefaultVardiff{}, nil
+	case "window":
+		if cfg.WindowSize <= 0 {
+			cfg.WindowSize = DEFAULT_WINDOW_SIZE
+		}
+		return WindowVardiff{Size: cfg.WindowSize}, nil
+	default:
+		return nil, fmt.Errorf("unknown vardiff algorithm %s", cfg.Algorithm)
+	}
+}
+
+// DefaultVardiff estimates the hashrate from the time since the previous share, and blends the
+// result with the previous difficulty
+type DefaultVardiff struct{}
+
+func (DefaultVardiff) NextDiff(c *Connection, shareDiff uint64, targetTime uint64) float64 {
+	t := time.Now().UnixMilli()
+	deltaT := t - c.LastShare
+	if deltaT < int64(targetTime*1000/4) {
+		deltaT = int64(targetTime * 1000 / 4)
+	} else if deltaT > int64(targetTime*1000*4) {
+		deltaT = int64(targetTime * 1000 * 4)
+	}
+	estHr := float64(shareDiff) / float64(deltaT)
+	nextDiff := estHr * 1000 * float64(targetTime)
+	return (nextDiff + 6*c.NextDiff) / 7
+}
+
+type vardiffShare struct {
+	Time int64 // unix milliseconds
+	Diff uint64
+}
+
+// WindowVardiff estimates the hashrate from the last Size shares. It reacts faster than
+// DefaultVardiff to hashrate changes, while being less noisy.
+type WindowVardiff struct {
+	Size int
+}
+
+func (w WindowVardiff) NextDiff(c *Connection, shareDiff uint64, targetTime uint64) float64 {
+	now := time.Now().UnixMilli()
+
+	// the first entry is only used for its time
+	if len(c.vardiffWindow) == 0 {
+		c.vardiffWindow = append(c.vardiffWindow, vardiffShare{Time: c.LastShare})
+	}
+	c.vardiffWindow = append(c.vardiffWindow, vardiffShare{Time: now, Diff: shareDiff})
+	if len(c.vardiffWindow) > w.Size+1 {
+		n := copy(c.vardiffWindow, c.vardiffWindow[len(c.vardiffWindow)-w.Size-1:])
+		c.vardiffWindow = c.vardiffWindow[:n]
+	}
+
+	var sum uint64
+	for _, v := range c.vardiffWindow[1:] {
+		sum += v.Diff
+	}
+	deltaT := now - c.vardiffWindow[0].Time
+	if deltaT < 1 {
+		deltaT = 1
+	}
+
+	estHr := float64(sum) / float64(deltaT)
+	nextDiff := estHr * 1000 * float64(targetTime)
+
+	return math.Max(c.NextDiff/MAX_WINDOW_STEP, math.Min(nextDiff, c.NextDiff*MAX_WINDOW_STEP))
+}
+
+// NeedsRetarget returns true if the target difficulty of c drifted enough from the difficulty of
+// its current job to send a new job right away. Connection must be locked.
+func (s *Server) NeedsRetarget(c *Connection) bool {
+	if s.RetargetPercent < 0 || c.CurrentJob.Diff == 0 {
+		return false
+	}
+	percent := s.RetargetPercent
+	if percent == 0 {
+		percent = DEFAULT_RETARGET_PERCENT
+	}
+
+	return math.Abs(c.NextDiff-float64(c.CurrentJob.Diff))*100/float64(c.CurrentJob.Diff) >= percent
+}
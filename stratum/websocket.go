@@ -0,0 +1,165 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-pool/config"
+	"go-pool/logger"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn adapts a WebSocket connection to the newline-delimited JSON stream used by the stratum
+// protocol. Each WebSocket message is a stratum message.
+type wsConn struct {
+	*websocket.Conn
+
+	remote net.Addr
+	buf    []byte // rest of the current message
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	if len(c.buf) == 0 {
+		var msg []byte
+		err := websocket.Message.Receive(c.Conn, &msg)
+		if err != nil {
+			return 0, err
+		}
+
+		// newlines can only be whitespace in JSON, and would split the message
+		msg = bytes.ReplaceAll(msg, []byte{'\n'}, []byte{' '})
+		c.buf = append(msg, '\n')
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	// one message per write, without the newline delimiter
+	err := websocket.Message.Send(c.Conn, string(bytes.TrimRight(b, "\n")))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// RemoteAddr returns the address of the miner
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// serveWebSocket accepts the stratum connections over WebSocket. The trusted proxies pass the
+// address of the miners with X-Forwarded-For or X-Real-IP.
+func (s *Server) serveWebSocket(listener net.Listener, l *config.ListenerConfig, trusted []*net.IPNet) {
+	wsServer := websocket.Server{
+		Handshake: func(_ *websocket.Config, r *http.Request) error {
+			return checkOrigin(r.Header.Get("Origin"), l.Origins)
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.MaxPayloadBytes = config.MAX_REQUEST_SIZE
+
+			c := &wsConn{
+				Conn:   ws,
+				remote: wsRemoteAddr(ws.Request(), trusted),
+				closed: make(chan struct{}),
+			}
+			s.accept(c, l)
+
+			// the WebSocket is closed when the handler returns
+			<-c.closed
+		},
+	}
+
+	httpServer := &http.Server{
+		Handler:           wsServer,
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    8192,
+	}
+	err := httpServer.Serve(listener)
+	if !errors.Is(err, net.ErrClosed) {
+		logger.Error("WebSocket server stopped:", err)
+	}
+}
+
+// checkOrigin returns an error if the Origin of a browser isn't allowed. Stratum miners don't send
+// an Origin.
+func checkOrigin(origin string, allowed []string) error {
+	if origin == "" {
+		return nil
+	}
+	for _, v := range allowed {
+		if v == "*" || strings.EqualFold(v, origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s not allowed", origin)
+}
+
+func wsRemoteAddr(r *http.Request, trusted []*net.IPNet) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	addr := &net.TCPAddr{
+		IP: net.ParseIP(host),
+	}
+	addr.Port, _ = net.LookupPort("tcp", port)
+
+	isTrusted := false
+	for _, v := range trusted {
+		if v.Contains(addr.IP) {
+			isTrusted = true
+			break
+		}
+	}
+	if !isTrusted {
+		return addr
+	}
+
+	// the last address was added by the trusted proxy
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if forwarded == "" {
+		forwarded = r.Header.Get("X-Real-IP")
+	}
+	list := strings.Split(forwarded, ",")
+	ip := net.ParseIP(strings.TrimSpace(list[len(list)-1]))
+	if ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	return addr
+}
@@ -0,0 +1,76 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stratum
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		origin  string
+		allowed []string
+		ok      bool
+	}{
+		{"", nil, true}, // stratum miner
+		{"", []string{"https://example.com"}, true},
+		{"https://example.com", nil, false},
+		{"https://example.com", []string{"https://example.com"}, true},
+		{"https://EXAMPLE.com", []string{"https://example.com"}, true},
+		{"https://evil.com", []string{"https://example.com"}, false},
+		{"http://example.com", []string{"https://example.com"}, false},
+		{"https://evil.com", []string{"https://example.com", "*"}, true},
+	}
+
+	for _, v := range tests {
+		if err := checkOrigin(v.origin, v.allowed); (err == nil) != v.ok {
+			t.Errorf("origin %q, allowed %v: got %v", v.origin, v.allowed, err)
+		}
+	}
+}
+
+func TestWsRemoteAddr(t *testing.T) {
+	_, proxy, _ := net.ParseCIDR("10.0.0.0/8")
+	trusted := []*net.IPNet{proxy}
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		ip        string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.7", "203.0.113.5"}, // not a trusted proxy
+		{"10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:1234", "1.2.3.4, 198.51.100.7", "198.51.100.7"}, // the first one is sent by the miner
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "garbage", "10.0.0.1"},
+	}
+
+	for _, v := range tests {
+		r := &http.Request{RemoteAddr: v.remote, Header: http.Header{}}
+		if v.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", v.forwarded)
+		}
+		addr := wsRemoteAddr(r, trusted).(*net.TCPAddr)
+		if addr.IP.String() != v.ip {
+			t.Errorf("%s forwarding %q: got %s, expected %s", v.remote, v.forwarded, addr.IP, v.ip)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package template
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// blocktemplate_blob
+// block header: major version, minor version, timestamp (varints), prev id (32 bytes), nonce (4 bytes)
+// miner tx: prefix (version, unlock time, inputs, outputs, extra), rct base (tx version >= 2)
+// tx hashes: count (varint), count*32 bytes
+//
+// blockhashing_blob
+// block header, tree root hash (32 bytes), number of transactions including the miner tx (varint)
+
+const txinGenTag = 0xff
+const txoutToKeyTag = 0x02
+const txoutToTaggedKeyTag = 0x03
+
+// Prepare parses the template blob, so that blobs with a different extra nonce can be built with
+// WithExtraNonce without asking the daemon for a new template.
+// If HashingBlob is set, the blockhashing blob built locally is checked against it.
+func (t *Template) Prepare() error {
+	t.ready = false
+
+	d := blobReader{data: t.Blob}
+
+	// block header
+	d.readVarint() // major version
+	d.readVarint() // minor version
+	d.readVarint() // timestamp
+	d.skip(32)     // prev id
+	d.skip(4)      // nonce
+	t.minerTxStart = d.pos
+
+	// miner tx prefix
+	txVersion := d.readVarint()
+	d.readVarint() // unlock time
+	numInputs := d.readVarint()
+	if d.err == nil && numInputs != 1 {
+		return fmt.Errorf("miner tx has %d inputs", numInputs)
+	}
+	if tag := d.readByte(); d.err == nil && tag != txinGenTag {
+		return fmt.Errorf("miner tx input has unknown tag %d", tag)
+	}
+	d.readVarint() // height
+	numOutputs := d.readVarint()
+	for i := uint64(0); i < numOutputs && d.err == nil; i++ {
+		d.readVarint() // amount
+		switch tag := d.readByte(); tag {
+		case txoutToKeyTag:
+			d.skip(32)
+		case txoutToTaggedKeyTag:
+			d.skip(32 + 1)
+		default:
+			if d.err == nil {
+				return fmt.Errorf("miner tx output has unknown tag %d", tag)
+			}
+		}
+	}
+	extraLen := d.readVarint()
+	extraStart := d.pos
+	d.skip(int(extraLen))
+	t.minerTxPrefixEnd = d.pos
+
+	// rct base of the miner tx: only the type, which is always RCTTypeNull
+	if txVersion >= 2 {
+		if rctType := d.readByte(); d.err == nil && rctType != 0 {
+			return fmt.Errorf("miner tx has unexpected rct type %d", rctType)
+		}
+	}
+	t.minerTxEnd = d.pos
+	t.minerTxVersion = txVersion
+
+	numTxs := d.readVarint()
+	if d.err == nil && numTxs > uint64(len(t.Blob)/32) {
+		return fmt.Errorf("invalid number of transactions %d", numTxs)
+	}
+	hashes := make([][]byte, numTxs+1)
+	for i := uint64(1); i <= numTxs && d.err == nil; i++ {
+		hashes[i] = d.read(32)
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	if d.pos != len(t.Blob) {
+		return fmt.Errorf("template blob has %d trailing bytes", len(t.Blob)-d.pos)
+	}
+	if t.ReservedSize <= 0 || t.ReservedOffset < extraStart || t.ReservedOffset+t.ReservedSize > t.minerTxPrefixEnd {
+		return fmt.Errorf("reserved offset %d is outside of the miner tx extra", t.ReservedOffset)
+	}
+
+	t.numTxs = numTxs + 1
+	t.treeBranch = treeBranch(hashes)
+	t.ready = true
+
+	if len(t.HashingBlob) != 0 {
+		_, hashingBlob, _ := t.WithExtraNonce(t.Blob[t.ReservedOffset : t.ReservedOffset+t.ReservedSize])
+		if !bytes.Equal(hashingBlob, t.HashingBlob) {
+			t.ready = false
+			return fmt.Errorf("blockhashing blob mismatch: built %s, daemon has %s",
+				hex.EncodeToString(hashingBlob), hex.EncodeToString(t.HashingBlob))
+		}
+	}
+
+	return nil
+}
+
+// WithExtraNonce returns a copy of the block template blob with extraNonce written in the reserved
+// space, and the matching blockhashing blob. The template must have been prepared with Prepare.
+func (t *Template) WithExtraNonce(extraNonce []byte) (blob []byte, hashingBlob []byte, err error) {
+	if !t.ready {
+		return nil, nil, errors.New("template is not prepared")
+	}
+	if len(extraNonce) > t.ReservedSize {
+		return nil, nil, fmt.Errorf("extra nonce is %d bytes, reserved size is %d", len(extraNonce), t.ReservedSize)
+	}
+
+	blob = make([]byte, len(t.Blob))
+	copy(blob, t.Blob)
+	copy(blob[t.ReservedOffset:], extraNonce)
+
+	var minerTxHash []byte
+	if t.minerTxVersion >= 2 {
+		minerTxHash = keccak(
+			keccak(blob[t.minerTxStart:t.minerTxPrefixEnd]),
+			keccak(blob[t.minerTxPrefixEnd:t.minerTxEnd]),
+			make([]byte, 32), // prunable hash of a RCTTypeNull transaction
+		)
+	} else {
+		minerTxHash = keccak(blob[t.minerTxStart:t.minerTxEnd])
+	}
+
+	root := minerTxHash
+	for _, v := range t.treeBranch {
+		root = keccak(root, v)
+	}
+
+	hashingBlob = make([]byte, 0, t.minerTxStart+32+binary.MaxVarintLen64)
+	hashingBlob = append(hashingBlob, blob[:t.minerTxStart]...)
+	hashingBlob = append(hashingBlob, root...)
+	hashingBlob = binary.AppendUvarint(hashingBlob, t.numTxs)
+
+	return blob, hashingBlob, nil
+}
+
+// treeBranch returns the hashes that need to be combined with hashes[0] to obtain the
+// Cryptonote tree root hash. hashes[0] itself is not read.
+func treeBranch(hashes [][]byte) [][]byte {
+	count := len(hashes)
+	switch count {
+	case 1:
+		return nil
+	case 2:
+		return [][]byte{hashes[1]}
+	}
+
+	cnt := 2
+	for cnt < count {
+		cnt <<= 1
+	}
+	cnt >>= 1
+
+	branch := make([][]byte, 0, 8)
+	ints := make([][]byte, cnt)
+
+	skip := 2*cnt - count
+	copy(ints, hashes[:skip])
+	if skip == 0 {
+		branch = append(branch, hashes[1])
+	}
+	for i, j := skip, skip; j < cnt; i, j = i+2, j+1 {
+		if i == 0 {
+			continue // depends on hashes[0]
+		}
+		ints[j] = keccak(hashes[i], hashes[i+1])
+	}
+
+	for cnt > 2 {
+		branch = append(branch, ints[1])
+		cnt >>= 1
+		for i, j := 2, 1; j < cnt; i, j = i+2, j+1 {
+			ints[j] = keccak(ints[i], ints[i+1])
+		}
+	}
+
+	return append(branch, ints[1])
+}
+
+func keccak(data ...[]byte) []byte {
+	k := sha3.NewLegacyKeccak256()
+	for _, v := range data {
+		k.Write(v)
+	}
+	return k.Sum(make([]byte, 0, 32))
+}
+
+type blobReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *blobReader) readVarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.err = fmt.Errorf("invalid varint at offset %d", r.pos)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+func (r *blobReader) readByte() byte {
+	b := r.read(1)
+	if r.err != nil {
+		return 0
+	}
+	return b[0]
+}
+func (r *blobReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data)-r.pos < n {
+		r.err = fmt.Errorf("unexpected end of blob at offset %d", r.pos)
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+func (r *blobReader) skip(n int) {
+	r.read(n)
+}
@@ -0,0 +1,334 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package template
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// refTreeHash is a direct port of tree_hash from Monero's crypto/tree-hash.c
+func refTreeHash(hashes [][]byte) []byte {
+	count := len(hashes)
+	switch count {
+	case 1:
+		return hashes[0]
+	case 2:
+		return keccak(hashes[0], hashes[1])
+	}
+
+	cnt := 2
+	for cnt < count {
+		cnt <<= 1
+	}
+	cnt >>= 1
+
+	ints := make([][]byte, cnt)
+	copy(ints, hashes[:2*cnt-count])
+	for i, j := 2*cnt-count, 2*cnt-count; j < cnt; i, j = i+2, j+1 {
+		ints[j] = keccak(hashes[i], hashes[i+1])
+	}
+	for cnt > 2 {
+		cnt >>= 1
+		for i, j := 0, 0; j < cnt; i, j = i+2, j+1 {
+			ints[j] = keccak(ints[i], ints[i+1])
+		}
+	}
+	return keccak(ints[0], ints[1])
+}
+
+func testHashes(n int) [][]byte {
+	hashes := make([][]byte, n)
+	for i := range hashes {
+		hashes[i] = keccak([]byte("tx " + strconv.Itoa(i)))
+	}
+	return hashes
+}
+
+func branchRoot(hashes [][]byte) []byte {
+	root := hashes[0]
+	for _, v := range treeBranch(hashes) {
+		root = keccak(root, v)
+	}
+	return root
+}
+
+func TestTreeBranch(t *testing.T) {
+	h := testHashes(8)
+
+	// the trees of the smallest counts, written out
+	vectors := []struct {
+		count int
+		root  []byte
+	}{
+		{1, h[0]},
+		{2, keccak(h[0], h[1])},
+		{3, keccak(h[0], keccak(h[1], h[2]))},
+		{4, keccak(keccak(h[0], h[1]), keccak(h[2], h[3]))},
+		{5, keccak(keccak(h[0], h[1]), keccak(h[2], keccak(h[3], h[4])))},
+		{8, keccak(
+			keccak(keccak(h[0], h[1]), keccak(h[2], h[3])),
+			keccak(keccak(h[4], h[5]), keccak(h[6], h[7])),
+		)},
+	}
+	for _, v := range vectors {
+		if root := branchRoot(h[:v.count]); !bytes.Equal(root, v.root) {
+			t.Errorf("%d hashes: root %x, expected %x", v.count, root, v.root)
+		}
+	}
+
+	for _, n := range []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 15, 16, 17, 31, 33, 100, 257} {
+		hashes := testHashes(n)
+		if root, expected := branchRoot(hashes), refTreeHash(hashes); !bytes.Equal(root, expected) {
+			t.Errorf("%d hashes: root %x, expected %x", n, root, expected)
+		}
+	}
+}
+
+// testTemplate is a block template built piece by piece, so that the expected blobs can be
+// computed without parsing it
+type testTemplate struct {
+	header   []byte
+	prefix   []byte // miner tx prefix
+	rctBase  []byte
+	txHashes [][]byte
+
+	reservedOffset int // in the prefix
+	reservedSize   int
+}
+
+func newTestTemplate(txVersion uint64, numTxs int, taggedOutputs bool) *testTemplate {
+	tt := &testTemplate{
+		reservedSize: 8,
+	}
+
+	tt.header = binary.AppendUvarint(nil, 16)                // major version
+	tt.header = binary.AppendUvarint(tt.header, 16)          // minor version
+	tt.header = binary.AppendUvarint(tt.header, 1700000000)  // timestamp
+	tt.header = append(tt.header, keccak([]byte("prev"))...) // prev id
+	tt.header = append(tt.header, 0, 0, 0, 0)                // nonce
+
+	height := uint64(3000000)
+	p := binary.AppendUvarint(nil, txVersion)
+	p = binary.AppendUvarint(p, height+60) // unlock time
+	p = binary.AppendUvarint(p, 1)         // inputs
+	p = append(p, txinGenTag)
+	p = binary.AppendUvarint(p, height)
+	p = binary.AppendUvarint(p, 2) // outputs
+	for i := 0; i < 2; i++ {
+		p = binary.AppendUvarint(p, 600000000000+uint64(i))
+		if taggedOutputs {
+			p = append(p, txoutToTaggedKeyTag)
+			p = append(p, keccak([]byte{byte(i)})...)
+			p = append(p, 0xab) // view tag
+		} else {
+			p = append(p, txoutToKeyTag)
+			p = append(p, keccak([]byte{byte(i)})...)
+		}
+	}
+
+	// tx public key, then the extra nonce where the daemon reserves space
+	extra := append([]byte{0x01}, keccak([]byte("tx key"))...)
+	extra = append(extra, 0x02, byte(tt.reservedSize))
+	p = binary.AppendUvarint(p, uint64(len(extra)+tt.reservedSize))
+	p = append(p, extra...)
+	tt.reservedOffset = len(p)
+	p = append(p, make([]byte, tt.reservedSize)...)
+	tt.prefix = p
+
+	if txVersion >= 2 {
+		tt.rctBase = []byte{0} // RCTTypeNull
+	}
+	tt.txHashes = testHashes(numTxs)
+
+	return tt
+}
+
+func (tt *testTemplate) blob() []byte {
+	b := append([]byte(nil), tt.header...)
+	b = append(b, tt.prefix...)
+	b = append(b, tt.rctBase...)
+	b = binary.AppendUvarint(b, uint64(len(tt.txHashes)))
+	for _, v := range tt.txHashes {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// hashingBlob follows get_block_hashing_blob and get_transaction_hash of Monero
+func (tt *testTemplate) hashingBlob(extraNonce []byte) []byte {
+	prefix := append([]byte(nil), tt.prefix...)
+	copy(prefix[tt.reservedOffset:], extraNonce)
+
+	var minerTxHash []byte
+	if tt.rctBase != nil {
+		minerTxHash = keccak(keccak(prefix), keccak(tt.rctBase), make([]byte, 32))
+	} else {
+		minerTxHash = keccak(prefix)
+	}
+
+	b := append([]byte(nil), tt.header...)
+	b = append(b, refTreeHash(append([][]byte{minerTxHash}, tt.txHashes...))...)
+	return binary.AppendUvarint(b, uint64(len(tt.txHashes)+1))
+}
+
+func (tt *testTemplate) template() *Template {
+	return &Template{
+		Blob:           tt.blob(),
+		HashingBlob:    tt.hashingBlob(nil),
+		ReservedOffset: len(tt.header) + tt.reservedOffset,
+		ReservedSize:   tt.reservedSize,
+	}
+}
+
+func TestWithExtraNonce(t *testing.T) {
+	nonces := [][]byte{
+		nil,
+		{1},
+		{0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 1},
+		bytes.Repeat([]byte{0xff}, 8),
+	}
+
+	for _, version := range []uint64{1, 2} {
+		for _, numTxs := range []int{0, 1, 2, 3, 4, 7, 16, 100} {
+			for _, tagged := range []bool{false, true} {
+				tt := newTestTemplate(version, numTxs, tagged)
+				tmpl := tt.template()
+
+				// Prepare also compares its hashing blob with HashingBlob
+				err := tmpl.Prepare()
+				if err != nil {
+					t.Fatalf("v%d, %d txs: %v", version, numTxs, err)
+				}
+
+				for _, nonce := range nonces {
+					blob, hashingBlob, err := tmpl.WithExtraNonce(nonce)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					expectedBlob := tt.blob()
+					copy(expectedBlob[tmpl.ReservedOffset:], nonce)
+					if !bytes.Equal(blob, expectedBlob) {
+						t.Errorf("v%d, %d txs, nonce %x: wrong blob", version, numTxs, nonce)
+					}
+					if expected := tt.hashingBlob(nonce); !bytes.Equal(hashingBlob, expected) {
+						t.Errorf("v%d, %d txs, nonce %x: hashing blob %x, expected %x", version, numTxs, nonce,
+							hashingBlob, expected)
+					}
+				}
+
+				if !bytes.Equal(tmpl.Blob, tt.blob()) {
+					t.Fatal("WithExtraNonce modified the template")
+				}
+			}
+		}
+	}
+}
+
+func TestPrepareErrors(t *testing.T) {
+	tt := newTestTemplate(2, 3, true)
+
+	tmpl := &Template{}
+	if _, _, err := tmpl.WithExtraNonce(nil); err == nil {
+		t.Error("unprepared template accepted")
+	}
+
+	tmpl = tt.template()
+	tmpl.Prepare()
+	if _, _, err := tmpl.WithExtraNonce(make([]byte, tt.reservedSize+1)); err == nil {
+		t.Error("extra nonce bigger than the reserved size accepted")
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Template)
+	}{
+		{"truncated", func(t *Template) { t.Blob = t.Blob[:len(t.Blob)-1] }},
+		{"trailing bytes", func(t *Template) { t.Blob = append(t.Blob, 0) }},
+		{"empty", func(t *Template) { t.Blob = nil }},
+		{"offset in header", func(t *Template) { t.ReservedOffset = 10 }},
+		{"offset after extra", func(t *Template) { t.ReservedOffset += 1 }},
+		{"no reserved size", func(t *Template) { t.ReservedSize = 0 }},
+		{"wrong hashing blob", func(t *Template) { t.HashingBlob[len(t.HashingBlob)-2]++ }},
+		{"too many txs", func(t *Template) {
+			// the tx count is the byte before the 3 hashes
+			t.Blob[len(t.Blob)-3*32-1] = 0x7f
+		}},
+	}
+	for _, v := range tests {
+		tmpl := tt.template()
+		v.modify(tmpl)
+		if err := tmpl.Prepare(); err == nil {
+			t.Errorf("%s: template accepted", v.name)
+		}
+		if _, _, err := tmpl.WithExtraNonce(nil); err == nil {
+			t.Errorf("%s: template is usable after a failed Prepare", v.name)
+		}
+	}
+}
+
+// TestDaemonTemplates checks the templates saved in testdata/block_templates.json, if any. The file
+// is a list of {"reserve_size": N, "result": <get_block_template result>}, captured with:
+//
+//	curl http://127.0.0.1:18081/json_rpc -d '{"jsonrpc":"2.0","id":"0","method":"get_block_template",
+//		"params":{"wallet_address":"...","reserve_size":8}}'
+func TestDaemonTemplates(t *testing.T) {
+	data, err := os.ReadFile("testdata/block_templates.json")
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skip("no daemon templates in testdata")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	var templates []struct {
+		ReserveSize int `json:"reserve_size"`
+		Result      struct {
+			BlocktemplateBlob string `json:"blocktemplate_blob"`
+			BlockhashingBlob  string `json:"blockhashing_blob"`
+			ReservedOffset    int    `json:"reserved_offset"`
+		} `json:"result"`
+	}
+	err = json.Unmarshal(data, &templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range templates {
+		blob, _ := hex.DecodeString(v.Result.BlocktemplateBlob)
+		hashingBlob, _ := hex.DecodeString(v.Result.BlockhashingBlob)
+		tmpl := &Template{
+			Blob:           blob,
+			HashingBlob:    hashingBlob,
+			ReservedOffset: v.Result.ReservedOffset,
+			ReservedSize:   v.ReserveSize,
+		}
+
+		// Prepare fails if its hashing blob differs from the daemon's
+		err := tmpl.Prepare()
+		if err != nil {
+			t.Errorf("template %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package template
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// WideDiff is a 128-bit difficulty, like the wide_difficulty of the daemon
+type WideDiff struct {
+	Hi uint64
+	Lo uint64
+}
+
+func NewWideDiff(d uint64) WideDiff {
+	return WideDiff{Lo: d}
+}
+
+// ParseWideDiff parses a hexadecimal difficulty, with or without the 0x prefix
+func ParseWideDiff(s string) (WideDiff, error) {
+	b, ok := big.NewInt(0).SetString(strings.TrimPrefix(s, "0x"), 16)
+	if !ok || b.Sign() < 0 || b.BitLen() > 128 {
+		return WideDiff{}, fmt.Errorf("invalid wide difficulty %s", s)
+	}
+
+	lo := big.NewInt(0).And(b, big.NewInt(0).SetUint64(math.MaxUint64))
+	return WideDiff{
+		Hi: b.Rsh(b, 64).Uint64(),
+		Lo: lo.Uint64(),
+	}, nil
+}
+
+func (d WideDiff) Big() *big.Int {
+	b := big.NewInt(0).SetUint64(d.Hi)
+	b.Lsh(b, 64)
+	return b.Or(b, big.NewInt(0).SetUint64(d.Lo))
+}
+
+func (d WideDiff) IsZero() bool {
+	return d.Hi == 0 && d.Lo == 0
+}
+
+// Uint64 returns the difficulty, or math.MaxUint64 if it doesn't fit in 64 bits
+func (d WideDiff) Uint64() uint64 {
+	if d.Hi != 0 {
+		return math.MaxUint64
+	}
+	return d.Lo
+}
+
+func (d WideDiff) String() string {
+	if d.Hi == 0 {
+		return fmt.Sprint(d.Lo)
+	}
+	return d.Big().String()
+}
+
+// CheckHash returns true if the hash meets the difficulty, like the check_hash of Cryptonote
+// daemons: the hash, as a 256-bit little endian number, multiplied by the difficulty must be
+// less than 2^256. Hashes that are not 32 bytes never meet it.
+func CheckHash(hash []byte, d WideDiff) bool {
+	if len(hash) != 32 {
+		return false
+	}
+	if d.IsZero() {
+		return true
+	}
+
+	h := big.NewInt(0).SetBytes(reverse2(hash))
+	return h.Mul(h, d.Big()).Cmp(&maxTarget) <= 0
+}
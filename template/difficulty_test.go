@@ -0,0 +1,143 @@
+/*
+ * This file is part of go-pool.
+ *
+ * go-pool is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * go-pool is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with go-pool. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package template
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestDiffToJobTarget(t *testing.T) {
+	tests := []struct {
+		diff   uint64
+		target string
+	}{
+		{0, "ffffffff"},
+		{1, "ffffffff"},
+		{1000, "37894100"},
+		{MAX_SHORT_TARGET_DIFF, "64000000"},             // the last 4-byte target
+		{MAX_SHORT_TARGET_DIFF + 1, "70feffff63000000"}, // the first 8-byte target
+		{math.MaxUint64, "0100000000000000"},
+	}
+
+	for _, v := range tests {
+		if target := DiffToJobTarget(v.diff); target != v.target {
+			t.Errorf("diff %d: target %s, expected %s", v.diff, target, v.target)
+		}
+	}
+}
+
+func TestParseWideDiff(t *testing.T) {
+	tests := []struct {
+		s    string
+		diff WideDiff
+		ok   bool
+	}{
+		{"0x1", WideDiff{Lo: 1}, true},
+		{"1", WideDiff{Lo: 1}, true},
+		{"0x5f5e100", WideDiff{Lo: 100000000}, true},
+		{"5f5e100", WideDiff{Lo: 100000000}, true},
+		{"0x10000000000000000", WideDiff{Hi: 1}, true},
+		{"0x123456789abcdef0fedcba9876543210", WideDiff{Hi: 0x123456789abcdef0, Lo: 0xfedcba9876543210}, true},
+		{"0xffffffffffffffffffffffffffffffff", WideDiff{Hi: math.MaxUint64, Lo: math.MaxUint64}, true},
+		{"0x100000000000000000000000000000000", WideDiff{}, false}, // 129 bits
+		{"", WideDiff{}, false},
+		{"0x", WideDiff{}, false},
+		{"0xg", WideDiff{}, false},
+		{"-0x1", WideDiff{}, false},
+	}
+
+	for _, v := range tests {
+		diff, err := ParseWideDiff(v.s)
+		if (err == nil) != v.ok {
+			t.Errorf("%q: got error %v", v.s, err)
+		} else if diff != v.diff {
+			t.Errorf("%q: got %+v, expected %+v", v.s, diff, v.diff)
+		}
+	}
+}
+
+// hashOf returns the little endian hash of the number 2^exp
+func hashOf(exp int) []byte {
+	hash := make([]byte, 32)
+	hash[exp/8] = 1 << (exp % 8)
+	return hash
+}
+
+func TestCheckHash(t *testing.T) {
+	zero := make([]byte, 32)
+	max := bytes.Repeat([]byte{0xff}, 32)
+	maxWide := WideDiff{Hi: math.MaxUint64, Lo: math.MaxUint64}
+
+	// check_hash: hash * difficulty < 2^256
+	tests := []struct {
+		name string
+		hash []byte
+		diff WideDiff
+		ok   bool
+	}{
+		{"nil", nil, NewWideDiff(1), false},
+		{"short", zero[:31], NewWideDiff(1), false},
+		{"long", append(zero, 0), NewWideDiff(1), false},
+		{"zero", zero, maxWide, true},
+		{"zero diff", max, WideDiff{}, true},
+		{"max hash, diff 1", max, NewWideDiff(1), true},
+		{"max hash, diff 2", max, NewWideDiff(2), false},
+		{"2^192, diff 2^64-1", hashOf(192), NewWideDiff(math.MaxUint64), true},
+		{"2^192, diff 2^64", hashOf(192), WideDiff{Hi: 1}, false},
+		{"2^128, max diff", hashOf(128), maxWide, true},
+		{"2^127, max diff", hashOf(127), maxWide, true},
+		{"2^129, max diff", hashOf(129), maxWide, false},
+	}
+
+	for _, v := range tests {
+		if ok := CheckHash(v.hash, v.diff); ok != v.ok {
+			t.Errorf("%s: got %v, expected %v", v.name, ok, v.ok)
+		}
+	}
+}
+
+func TestHashToDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		hash []byte
+		diff uint64
+	}{
+		{"nil", nil, 0},
+		{"short", make([]byte, 31), 0},
+		{"zero", make([]byte, 32), math.MaxUint64},
+		{"max", bytes.Repeat([]byte{0xff}, 32), 1},
+		{"2^255", hashOf(255), 1},
+		{"2^254", hashOf(254), 3},
+		{"2^192", hashOf(192), math.MaxUint64},
+		{"2^191", hashOf(191), math.MaxUint64},
+		{"2^200", hashOf(200), 1<<56 - 1},
+	}
+
+	for _, v := range tests {
+		if diff := HashToDiff(v.hash); diff != v.diff {
+			t.Errorf("%s: got %d, expected %d", v.name, diff, v.diff)
+		}
+
+		// the share check of the slave
+		if v.diff != 0 && !CheckHash(v.hash, NewWideDiff(v.diff)) {
+			t.Errorf("%s: the hash doesn't meet its own difficulty", v.name)
+		}
+	}
+}
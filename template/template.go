@@ -20,26 +20,53 @@ package template
 import (
 	"encoding/binary"
 	"encoding/hex"
-	"fmt"
 	"go-pool/logger"
+	"math"
 	"math/big"
-	"strconv"
 )
 
 type Template struct {
-	Blob           []byte
-	Difficulty     uint64
+	Blob           []byte // Blocktemplate blob
+	HashingBlob    []byte // Blockhashing blob, as returned by the daemon
+	Difficulty     WideDiff
 	Height         uint64
+	MajorVersion   uint
+	Reward         uint64
 	ReservedOffset int
+	ReservedSize   int
 	SeedHash       string
+
+	// set by Prepare
+	ready            bool
+	minerTxStart     int
+	minerTxPrefixEnd int
+	minerTxEnd       int
+	minerTxVersion   uint64
+	numTxs           uint64
+	treeBranch       [][]byte
 }
 type Job struct {
 	Algo     string `json:"algo"`
 	Blob     string `json:"blob"`   // The blockhashing blob
 	Height   uint64 `json:"height"` // only used in RandomX jobs
 	JobID    string `json:"job_id"`
-	SeedHash string `json:"seed_hash"` // only used in RandomX jobs
+	SeedHash string `json:"seed_hash,omitempty"` // only used in RandomX jobs
 	Target   string `json:"target"`
+
+	MajorVersion uint `json:"blockMajorVersion,omitempty"` // only used in the jobs without seed hash
+}
+
+// miner difficulties above this use 8-byte targets, since a 4-byte target is too imprecise
+// (the target is at least 100, so it's rounded by less than 1%)
+const MAX_SHORT_TARGET_DIFF = 0xffffffff / 100
+
+// DiffToJobTarget returns the target of a job of difficulty d: a 4-byte target, or an 8-byte
+// target for high difficulties
+func DiffToJobTarget(d uint64) string {
+	if d > MAX_SHORT_TARGET_DIFF {
+		return hex.EncodeToString(DiffToTarget(d))
+	}
+	return DiffToShortTarget(d)
 }
 
 // Converts an uint64 diff to a 4-bytes target used by xmrig
@@ -48,7 +75,7 @@ func DiffToShortTarget(d uint64) string {
 	if d == 0 {
 		return "ffffffff"
 	}
-	minerDiff, _ := big.NewInt(0).SetString(strconv.FormatUint(d, 16), 16)
+	minerDiff := big.NewInt(0).SetUint64(d)
 	bigInt := big.NewInt(0).Div(bigInt64, minerDiff)
 	buf := bigInt.Bytes()
 	reverse(buf)
@@ -65,11 +92,11 @@ func DiffToTarget(d uint64) []byte {
 	if d == 0 {
 		return []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 	}
-	minerDiff, _ := big.NewInt(0).SetString(strconv.FormatUint(d, 16), 16)
+	minerDiff := big.NewInt(0).SetUint64(d)
 	bigInt := big.NewInt(0).Div(bigInt64, minerDiff)
 	buf := bigInt.Bytes()
 	reverse(buf)
-	for len(buf) < 4 {
+	for len(buf) < 8 {
 		buf = append(buf, 0)
 	}
 	return buf
@@ -96,22 +123,30 @@ const midDiffTarget uint64 = 0xffffffffffffffff
 func init() {
 	maxTarget.SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", 16)
 }
+
+// HashToDiff returns the difficulty of a 32-byte hash, or math.MaxUint64 if it doesn't fit in 64
+// bits (an all-zero hash meets any difficulty). Invalid hashes have difficulty 0. Use CheckHash to
+// compare hashes to wide difficulties.
 func HashToDiff(hash []byte) uint64 {
-	var diff = big.NewInt(0).SetBytes(reverse2(hash[:]))
-	if diff.Int64() == 0 {
+	if len(hash) != 32 {
 		return 0
 	}
+	var diff = big.NewInt(0).SetBytes(reverse2(hash))
+	if diff.Sign() == 0 {
+		return math.MaxUint64
+	}
 	diff.Div(&maxTarget, diff)
 	if diff.IsUint64() {
 		return diff.Uint64()
 	}
-	panic(fmt.Sprintf("THIS SHOULD NEVER HAPPEN!!!!! diff is %d", diff))
+	return math.MaxUint64
 }
 
 // Converts 4-byte short diff to uint64 diff
 func ShortDiffToDiff(shortDiff []byte) uint64 {
 	if len(shortDiff) != 4 {
-		logger.Fatal("short diff length is not 4:", hex.EncodeToString(shortDiff))
+		logger.Warn("short diff length is not 4:", hex.EncodeToString(shortDiff))
+		return 0
 	}
 	var diff = uint64(binary.LittleEndian.Uint32(shortDiff[:]))
 	if diff == 0 {
@@ -124,7 +159,8 @@ func ShortDiffToDiff(shortDiff []byte) uint64 {
 // Converts 8-byte short diff to uint64 diff
 func MidDiffToDiff(midDiff []byte) uint64 {
 	if len(midDiff) != 8 {
-		logger.Fatal("mid diff length is not 8:", hex.EncodeToString(midDiff))
+		logger.Warn("mid diff length is not 8:", hex.EncodeToString(midDiff))
+		return 0
 	}
 	var diff = binary.LittleEndian.Uint64(midDiff[:])
 	if diff == 0 {
@@ -62,7 +62,7 @@ func Time() uint64 {
 }
 
 // Extremely fast function! Written to be as fast as possible.
-func IsHex(s string) bool {
+func IsHex(s []byte) bool {
 	for _, v := range s {
 		if (v < '0' || v > '9') && (v < 'a' || v > 'f') {
 			return false